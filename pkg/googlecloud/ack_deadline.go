@@ -0,0 +1,237 @@
+package googlecloud
+
+import (
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/pkg/errors"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+var (
+	// ErrAckDeadlineNotExtendable happens when extending the ack deadline of a message
+	// that wasn't received by the Subscriber, or when ReceiveSettings.MaxExtension is negative.
+	ErrAckDeadlineNotExtendable = errors.New("ack deadline of the message can't be extended")
+	// ErrAckDeadlineExpired happens when extending the ack deadline of a message whose deadline already expired.
+	// The message was nacked and is going to be redelivered.
+	ErrAckDeadlineExpired = errors.New("ack deadline of the message expired")
+	// ErrMaxAckExtensionExceeded happens with ReceiveModeStreamingPull when the requested ack deadline is later than
+	// ReceiveSettings.MaxExtension after the message was received. The deadline is extended up to ReceiveSettings.MaxExtension.
+	ErrMaxAckExtensionExceeded = errors.New("requested ack deadline exceeds max extension")
+)
+
+type messageLeaseKey struct{}
+
+// messageLease tracks the ack deadline of a message received by the Subscriber.
+// The Subscriber nacks the message when the deadline set with DefaultAckExtension or ExtendAckDeadline expires.
+// Until any deadline is set, the message is never nacked because of the lease, and a deadline
+// not later than keepAliveUntil is not set.
+type messageLease struct {
+	// maxDeadline limits the deadline set by ExtendAckDeadline. It's zero if the deadline is not limited.
+	maxDeadline time.Time
+	// keepAliveUntil is how long the ack deadline in Pub/Sub is extended if no deadline is set.
+	keepAliveUntil time.Time
+
+	lock     sync.Mutex
+	deadline time.Time
+	timer    *time.Timer
+	expired  chan struct{}
+}
+
+func newMessageLease(defaultExtension time.Duration, maxDeadline, keepAliveUntil time.Time) *messageLease {
+	l := &messageLease{
+		maxDeadline:    maxDeadline,
+		keepAliveUntil: keepAliveUntil,
+		expired:        make(chan struct{}),
+	}
+	if defaultExtension > 0 {
+		l.deadline = time.Now().Add(defaultExtension)
+		l.timer = time.AfterFunc(defaultExtension, l.expire)
+	}
+
+	return l
+}
+
+func (l *messageLease) expire() {
+	close(l.expired)
+}
+
+// Expired returns a channel that is closed when the ack deadline expires.
+// It returns nil for a nil lease, so it can be used in select without checks.
+func (l *messageLease) Expired() <-chan struct{} {
+	if l == nil {
+		return nil
+	}
+
+	return l.expired
+}
+
+func (l *messageLease) extend(extension time.Duration) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var err error
+	deadline := time.Now().Add(extension)
+	if !l.maxDeadline.IsZero() && deadline.After(l.maxDeadline) {
+		deadline = l.maxDeadline
+		err = ErrMaxAckExtensionExceeded
+	}
+
+	if l.timer == nil {
+		// Until a deadline is set, the ack deadline is kept alive until keepAliveUntil,
+		// so a shorter extension must not make the message nacked sooner.
+		if !deadline.After(l.keepAliveUntil) {
+			return err
+		}
+
+		l.deadline = deadline
+		l.timer = time.AfterFunc(time.Until(deadline), l.expire)
+		return err
+	}
+
+	if !deadline.After(l.deadline) {
+		return err
+	}
+
+	if !l.timer.Stop() {
+		return ErrAckDeadlineExpired
+	}
+	l.timer.Reset(time.Until(deadline))
+	l.deadline = deadline
+
+	return err
+}
+
+// keepAlive returns true if the ack deadline of the message in Pub/Sub should still be extended at now.
+func (l *messageLease) keepAlive(now time.Time) bool {
+	if l == nil {
+		return false
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if !l.deadline.IsZero() {
+		return now.Before(l.deadline)
+	}
+
+	return now.Before(l.keepAliveUntil)
+}
+
+func (l *messageLease) stop() {
+	if l == nil {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.timer != nil {
+		l.timer.Stop()
+	}
+}
+
+// newStreamingMessageLease creates the lease of a message received with ReceiveModeStreamingPull.
+// The client library extends the ack deadline in Pub/Sub only up to ReceiveSettings.MaxExtension,
+// so the lease can't be extended beyond it.
+func (s *Subscriber) newStreamingMessageLease() *messageLease {
+	maxExtension := s.config.maxAckExtension()
+	if maxExtension <= 0 {
+		return nil
+	}
+
+	maxDeadline := time.Now().Add(maxExtension)
+
+	return newMessageLease(s.config.DefaultAckExtension, maxDeadline, maxDeadline)
+}
+
+// newPulledMessageLease creates the lease of a message received with ReceiveModeSynchronousPull.
+// The ack deadline in Pub/Sub is extended with ModifyAckDeadline requests for as long as the lease requires,
+// so it's extended up to ReceiveSettings.MaxExtension by default, but ExtendAckDeadline is not limited by it.
+func (s *Subscriber) newPulledMessageLease() *messageLease {
+	maxExtension := s.config.maxAckExtension()
+	if maxExtension <= 0 {
+		return nil
+	}
+
+	return newMessageLease(s.config.DefaultAckExtension, time.Time{}, time.Now().Add(maxExtension))
+}
+
+// ExtendAckDeadline extends the ack deadline of a message received by the Subscriber to the extension from now,
+// so the message is not redelivered while the handler is still processing it.
+//
+// Only ReceiveModeSynchronousPull can extend the ack deadline beyond ReceiveSettings.MaxExtension.
+// With the default ReceiveModeStreamingPull, the deadline can't be extended beyond ReceiveSettings.MaxExtension
+// after the message was received: increase ReceiveSettings.MaxExtension or use ReceiveModeSynchronousPull
+// if handlers need more time.
+//
+// It never shortens the ack deadline: without DefaultAckExtension, the ack deadline is already extended
+// up to ReceiveSettings.MaxExtension after the message was received, and an earlier extension is a no-op.
+// Once a deadline set with ExtendAckDeadline or DefaultAckExtension expires, the message is nacked by the Subscriber.
+//
+// With ReceiveModeSynchronousPull, the ack deadline of the message in Pub/Sub is extended with ModifyAckDeadline
+// requests until the requested deadline.
+//
+// With ReceiveModeStreamingPull, the client library manages the ack deadline in Pub/Sub and offers no way
+// to modify it for a single message, so ExtendAckDeadline only controls when the Subscriber nacks the message.
+// If a later deadline is requested, the deadline is set to ReceiveSettings.MaxExtension
+// and ErrMaxAckExtensionExceeded is returned.
+func ExtendAckDeadline(msg *message.Message, extension time.Duration) error {
+	lease, ok := msg.Context().Value(messageLeaseKey{}).(*messageLease)
+	if !ok {
+		return ErrAckDeadlineNotExtendable
+	}
+
+	return lease.extend(extension)
+}
+
+// AckDeadlineHeartbeat is a Watermill router middleware that extends the ack deadline of the message
+// every interval while the handler runs, so a long-running handler doesn't need to call ExtendAckDeadline.
+//
+// The heartbeat stops once the deadline can't be extended anymore,
+// for example when ReceiveSettings.MaxExtension is reached with ReceiveModeStreamingPull.
+func AckDeadlineHeartbeat(interval, extension time.Duration) message.HandlerMiddleware {
+	return func(h message.HandlerFunc) message.HandlerFunc {
+		return func(msg *message.Message) ([]*message.Message, error) {
+			done := make(chan struct{})
+			defer close(done)
+
+			go heartbeatAckDeadline(msg, interval, extension, done)
+
+			return h(msg)
+		}
+	}
+}
+
+func heartbeatAckDeadline(msg *message.Message, interval, extension time.Duration, done chan struct{}) {
+	if err := ExtendAckDeadline(msg, extension); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-msg.Context().Done():
+			return
+		case <-ticker.C:
+			if err := ExtendAckDeadline(msg, extension); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// maxAckExtension returns how long the client library keeps extending the ack deadline of a message.
+func (c SubscriberConfig) maxAckExtension() time.Duration {
+	if c.ReceiveSettings.MaxExtension == 0 {
+		return pubsub.DefaultReceiveSettings.MaxExtension
+	}
+
+	return c.ReceiveSettings.MaxExtension
+}
@@ -0,0 +1,108 @@
+package googlecloud
+
+import (
+	"context"
+	"sync"
+
+	"cloud.google.com/go/pubsub"
+	vkit "cloud.google.com/go/pubsub/apiv1"
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+	"google.golang.org/api/option"
+)
+
+// ErrClientPoolClosed happens when trying to get a client from a closed ClientPool.
+var ErrClientPoolClosed = errors.New("client pool is closed")
+
+// ClientPool shares Pub/Sub clients, and so their gRPC connections, between subscriptions,
+// and between Publishers and Subscribers. It keeps a single client per project, created on first use,
+// and a single low-level subscriber client used by ReceiveModeSynchronousPull.
+//
+// Publishers and Subscribers don't close the clients of the pool.
+// Close the pool after all Publishers and Subscribers using it are closed.
+type ClientPool struct {
+	clientOptions []option.ClientOption
+
+	lock                sync.Mutex
+	clients             map[string]*pubsub.Client
+	subscriberAPIClient *vkit.SubscriberClient
+	closed              bool
+}
+
+// NewClientPool creates a pool whose clients are created with the clientOptions.
+func NewClientPool(clientOptions ...option.ClientOption) *ClientPool {
+	return &ClientPool{
+		clientOptions: clientOptions,
+		clients:       map[string]*pubsub.Client{},
+	}
+}
+
+// Client returns the client of the project, creating it if it doesn't exist yet.
+func (p *ClientPool) Client(ctx context.Context, projectID string) (*pubsub.Client, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		return nil, ErrClientPoolClosed
+	}
+
+	if client, ok := p.clients[projectID]; ok {
+		return client, nil
+	}
+
+	// The client outlives the caller, so it must not be bound to the caller's cancellation.
+	client, err := pubsub.NewClient(context.WithoutCancel(ctx), projectID, p.clientOptions...)
+	if err != nil {
+		return nil, err
+	}
+	p.clients[projectID] = client
+
+	return client, nil
+}
+
+// subscriberAPI returns the low-level subscriber client, creating it if it doesn't exist yet.
+func (p *ClientPool) subscriberAPI(ctx context.Context) (*vkit.SubscriberClient, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		return nil, ErrClientPoolClosed
+	}
+
+	if p.subscriberAPIClient != nil {
+		return p.subscriberAPIClient, nil
+	}
+
+	client, err := newSubscriberAPIClient(context.WithoutCancel(ctx), p.clientOptions)
+	if err != nil {
+		return nil, err
+	}
+	p.subscriberAPIClient = client
+
+	return client, nil
+}
+
+// Close closes all clients of the pool.
+func (p *ClientPool) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+
+	var err error
+	for projectID, client := range p.clients {
+		if closeErr := client.Close(); closeErr != nil {
+			err = multierror.Append(err, errors.Wrapf(closeErr, "unable to close client of project %s", projectID))
+		}
+	}
+	if p.subscriberAPIClient != nil {
+		if closeErr := p.subscriberAPIClient.Close(); closeErr != nil {
+			err = multierror.Append(err, errors.Wrap(closeErr, "unable to close subscriber API client"))
+		}
+	}
+
+	return err
+}
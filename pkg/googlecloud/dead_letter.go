@@ -0,0 +1,123 @@
+package googlecloud
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/ThreeDotsLabs/watermill"
+)
+
+const (
+	minDeadLetterMaxDeliveryAttempts = 5
+	maxDeadLetterMaxDeliveryAttempts = 100
+
+	// maxDrainSubscriptionRetentionDuration is the longest retention of unacked messages allowed by Pub/Sub.
+	maxDrainSubscriptionRetentionDuration = 7 * 24 * time.Hour
+)
+
+// DeadLetterConfig configures the dead-letter topic of subscriptions created by the Subscriber.
+//
+// Messages that could not be acked after MaxDeliveryAttempts are forwarded by Pub/Sub to the dead-letter topic.
+// The Subscriber creates the dead-letter topic and a drain subscription on it, so forwarded messages are retained.
+//
+// Keep in mind that the Pub/Sub service account needs the publisher role on the dead-letter topic
+// and the subscriber role on the subscription, see https://cloud.google.com/pubsub/docs/handling-failures.
+type DeadLetterConfig struct {
+	// GenerateTopicName generates the dead-letter topic name for a given topic.
+	// By default, the "-dead-letter" suffix is added to the topic name.
+	GenerateTopicName func(topic string) string
+
+	// GenerateSubscriptionName generates the name of the drain subscription for a given dead-letter topic.
+	// By default, the dead-letter topic name is used.
+	GenerateSubscriptionName SubscriptionNameFn
+
+	// MaxDeliveryAttempts is the number of delivery attempts before a message is forwarded to the dead-letter topic.
+	// It must be between 5 and 100. By default, 5 is used.
+	MaxDeliveryAttempts int
+
+	// DrainSubscriptionRetentionDuration is how long the drain subscription retains the dead-lettered messages.
+	// It must be between 10 minutes and 7 days. By default, 7 days is used.
+	// The drain subscription never expires, even though it has no consumer.
+	DrainSubscriptionRetentionDuration time.Duration
+}
+
+func (c *DeadLetterConfig) setDefaults() {
+	if c.GenerateTopicName == nil {
+		c.GenerateTopicName = func(topic string) string {
+			return topic + "-dead-letter"
+		}
+	}
+	if c.GenerateSubscriptionName == nil {
+		c.GenerateSubscriptionName = TopicSubscriptionName
+	}
+	if c.MaxDeliveryAttempts == 0 {
+		c.MaxDeliveryAttempts = minDeadLetterMaxDeliveryAttempts
+	}
+	if c.DrainSubscriptionRetentionDuration == 0 {
+		c.DrainSubscriptionRetentionDuration = maxDrainSubscriptionRetentionDuration
+	}
+}
+
+func (c DeadLetterConfig) validate() error {
+	if c.MaxDeliveryAttempts < minDeadLetterMaxDeliveryAttempts || c.MaxDeliveryAttempts > maxDeadLetterMaxDeliveryAttempts {
+		return errors.Errorf(
+			"dead letter MaxDeliveryAttempts must be between %d and %d, got %d",
+			minDeadLetterMaxDeliveryAttempts,
+			maxDeadLetterMaxDeliveryAttempts,
+			c.MaxDeliveryAttempts,
+		)
+	}
+	if c.DrainSubscriptionRetentionDuration < 10*time.Minute || c.DrainSubscriptionRetentionDuration > maxDrainSubscriptionRetentionDuration {
+		return errors.Errorf(
+			"dead letter DrainSubscriptionRetentionDuration must be between 10m and %s, got %s",
+			maxDrainSubscriptionRetentionDuration,
+			c.DrainSubscriptionRetentionDuration,
+		)
+	}
+
+	return nil
+}
+
+// deadLetterPolicy creates the dead-letter topic and its drain subscription if they don't exist,
+// and returns the dead-letter policy for the subscription of topicName.
+func (s *Subscriber) deadLetterPolicy(ctx context.Context, client *pubsub.Client, topicName string) (*pubsub.DeadLetterPolicy, error) {
+	deadLetterTopicName := s.config.DeadLetter.GenerateTopicName(topicName)
+	drainSubscriptionName := s.config.DeadLetter.GenerateSubscriptionName(deadLetterTopicName)
+
+	logFields := watermill.LogFields{
+		"provider":                 ProviderName,
+		"topic":                    topicName,
+		"dead_letter_topic":        deadLetterTopicName,
+		"dead_letter_subscription": drainSubscriptionName,
+	}
+
+	t, err := s.config.topicProvisioner(s.logger).topic(ctx, client, deadLetterTopicName)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not provision dead letter topic")
+	}
+
+	// Nothing consumes from the drain subscription, so it must not expire because of inactivity,
+	// or it would be deleted together with the dead-lettered messages.
+	_, err = client.CreateSubscription(ctx, drainSubscriptionName, pubsub.SubscriptionConfig{
+		Topic:             t,
+		RetentionDuration: s.config.DeadLetter.DrainSubscriptionRetentionDuration,
+		ExpirationPolicy:  time.Duration(0),
+	})
+	if status.Code(err) == codes.AlreadyExists {
+		s.logger.Trace("Dead letter subscription already exists", logFields)
+	} else if err != nil {
+		return nil, errors.Wrap(err, "could not create dead letter subscription")
+	} else {
+		s.logger.Info("Created dead letter subscription", logFields)
+	}
+
+	return &pubsub.DeadLetterPolicy{
+		DeadLetterTopic:     t.String(),
+		MaxDeliveryAttempts: s.config.DeadLetter.MaxDeliveryAttempts,
+	}, nil
+}
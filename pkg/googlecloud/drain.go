@@ -0,0 +1,205 @@
+package googlecloud
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// DrainConfig configures Subscriber.SubscribeDrain.
+type DrainConfig struct {
+	// IdleTimeout defines how long `Subscriber` waits for the next message before the subscription is considered drained.
+	// By default, it waits for 10 seconds.
+	IdleTimeout time.Duration
+
+	// MaxMessages, if set, is the number of messages after which the subscription is considered drained.
+	MaxMessages int
+}
+
+func (c *DrainConfig) setDefaults() {
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = time.Second * 10
+	}
+}
+
+// DrainSummary summarizes the messages consumed with Subscriber.SubscribeDrain.
+type DrainSummary struct {
+	// Processed is the number of messages sent to the output channel.
+	// A nacked message that was redelivered is counted again.
+	Processed int
+	// Acked is the number of processed messages that were acked.
+	Acked int
+	// Nacked is the number of processed messages that were nacked,
+	// including the messages nacked because the subscriber was closed or ctx was canceled.
+	Nacked int
+}
+
+// DrainResult is the result of Subscriber.SubscribeDrain.
+type DrainResult struct {
+	ready   chan struct{}
+	summary DrainSummary
+	err     error
+}
+
+func newDrainResult() *DrainResult {
+	return &DrainResult{
+		ready: make(chan struct{}),
+	}
+}
+
+// Ready returns a channel that is closed when the result is available.
+// It happens after the output channel is closed and all processed messages are acked or nacked.
+func (r *DrainResult) Ready() <-chan struct{} {
+	return r.ready
+}
+
+// Get blocks until the subscription is drained or ctx is done.
+// It returns the summary of the consumed messages, and an error if the subscription was not drained,
+// because the ctx passed to SubscribeDrain was canceled or the Subscriber was closed.
+func (r *DrainResult) Get(ctx context.Context) (DrainSummary, error) {
+	select {
+	case <-r.ready:
+		return r.summary, r.err
+	case <-ctx.Done():
+		return DrainSummary{}, ctx.Err()
+	}
+}
+
+func (r *DrainResult) set(summary DrainSummary, err error) {
+	r.summary = summary
+	r.err = err
+	close(r.ready)
+}
+
+// SubscribeDrain works like Subscribe, but closes the output channel once the subscription is drained:
+// when no message was received for DrainConfig.IdleTimeout, or DrainConfig.MaxMessages were received.
+// It's useful for jobs that process the backlog of a subscription and exit.
+//
+// Messages that are sent to the output channel are still acked or nacked after it's drained.
+// The subscription is closed once all of them are acked or nacked, and then the DrainResult is ready.
+func (s *Subscriber) SubscribeDrain(ctx context.Context, topic string, config DrainConfig) (<-chan *message.Message, *DrainResult, error) {
+	config.setDefaults()
+
+	drainCtx, cancel := context.WithCancel(ctx)
+
+	messages, err := s.Subscribe(drainCtx, topic)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	logFields := watermill.LogFields{
+		"provider":          ProviderName,
+		"topic":             topic,
+		"subscription_name": s.config.GenerateSubscriptionName(topic),
+	}
+
+	output := make(chan *message.Message)
+	result := newDrainResult()
+
+	go func() {
+		summary, err := s.drain(ctx, messages, output, config, logFields)
+
+		cancel()
+		close(output)
+		// Messages received in the meantime are nacked, as the subscription context is canceled.
+		for range messages {
+		}
+
+		s.logger.Info("Subscription drained", logFields.Add(watermill.LogFields{
+			"processed": summary.Processed,
+			"acked":     summary.Acked,
+			"nacked":    summary.Nacked,
+		}))
+		result.set(summary, err)
+	}()
+
+	return output, result, nil
+}
+
+// drain forwards the messages to the output until the subscription is drained,
+// and waits until all forwarded messages are acked or nacked.
+func (s *Subscriber) drain(
+	ctx context.Context,
+	messages <-chan *message.Message,
+	output chan *message.Message,
+	config DrainConfig,
+	logFields watermill.LogFields,
+) (DrainSummary, error) {
+	var summary DrainSummary
+	summaryLock := sync.Mutex{}
+	processing := sync.WaitGroup{}
+
+	// interrupted returns the reason why the subscription was closed before it was drained.
+	interrupted := func() error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return ErrSubscriberClosed
+	}
+
+	err := func() error {
+		for config.MaxMessages == 0 || summary.Processed < config.MaxMessages {
+			var msg *message.Message
+			select {
+			case m, ok := <-messages:
+				if !ok {
+					return interrupted()
+				}
+				msg = m
+			case <-time.After(config.IdleTimeout):
+				s.logger.Debug("No message received within idle timeout, subscription is drained", logFields)
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+
+			select {
+			case output <- msg:
+			case <-msg.Context().Done():
+				// The message is nacked by the subscriber.
+				return interrupted()
+			}
+
+			summaryLock.Lock()
+			summary.Processed++
+			summaryLock.Unlock()
+
+			processing.Add(1)
+			go func() {
+				defer processing.Done()
+
+				select {
+				case <-msg.Acked():
+				case <-msg.Nacked():
+				case <-msg.Context().Done():
+				}
+
+				// The context is canceled also after the message is acked, so Acked takes precedence.
+				acked := false
+				select {
+				case <-msg.Acked():
+					acked = true
+				default:
+				}
+
+				summaryLock.Lock()
+				defer summaryLock.Unlock()
+				if acked {
+					summary.Acked++
+				} else {
+					summary.Nacked++
+				}
+			}()
+		}
+
+		return nil
+	}()
+
+	processing.Wait()
+
+	return summary, err
+}
@@ -0,0 +1,154 @@
+package googlecloud
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ThreeDotsLabs/watermill"
+)
+
+// CloseSummary summarizes the messages in flight when Subscriber.CloseWithContext was called.
+type CloseSummary struct {
+	// Drained is the number of messages delivered to the output channels
+	// that were acked or nacked by the handlers before the deadline.
+	Drained int
+	// Nacked is the number of messages delivered to the output channels
+	// that were not acked or nacked before the deadline, so they were nacked by `Subscriber`.
+	Nacked int
+}
+
+// inFlightMessages counts the messages delivered to the output channels that are not acked or nacked yet.
+type inFlightMessages struct {
+	lock     sync.Mutex
+	count    int
+	draining chan struct{}
+	// drained is closed once the `Subscriber` is draining and no messages are in flight.
+	drained chan struct{}
+	summary CloseSummary
+}
+
+func newInFlightMessages() *inFlightMessages {
+	return &inFlightMessages{
+		draining: make(chan struct{}),
+		drained:  make(chan struct{}),
+	}
+}
+
+// Draining returns a channel that is closed when the `Subscriber` starts draining.
+func (m *inFlightMessages) Draining() <-chan struct{} {
+	return m.draining
+}
+
+func (m *inFlightMessages) isDraining() bool {
+	select {
+	case <-m.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// sending marks a message as being sent to an output channel.
+// It's called before sending, so drain can't miss a message that is about to be delivered.
+// If the message is not sent after all, notSent must be called.
+func (m *inFlightMessages) sending() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.count++
+}
+
+// notSent unmarks a message that was marked with sending, but was not sent to the output channel.
+// It's not counted in the CloseSummary.
+func (m *inFlightMessages) notSent() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.count--
+	if m.isDraining() && m.count == 0 {
+		m.closeDrained()
+	}
+}
+
+// done marks a delivered message as acked or nacked.
+// handled is true if the message was acked or nacked by the handler, not by `Subscriber`.
+func (m *inFlightMessages) done(handled bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.count--
+	if !m.isDraining() {
+		return
+	}
+
+	if handled {
+		m.summary.Drained++
+	} else {
+		m.summary.Nacked++
+	}
+	if m.count == 0 {
+		m.closeDrained()
+	}
+}
+
+// drain starts draining and returns a channel that is closed once no messages are in flight.
+func (m *inFlightMessages) drain() <-chan struct{} {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if !m.isDraining() {
+		close(m.draining)
+	}
+	if m.count == 0 {
+		m.closeDrained()
+	}
+
+	return m.drained
+}
+
+func (m *inFlightMessages) closeDrained() {
+	select {
+	case <-m.drained:
+	default:
+		close(m.drained)
+	}
+}
+
+func (m *inFlightMessages) closeSummary() CloseSummary {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.summary
+}
+
+// CloseWithContext closes the `Subscriber` gracefully. It stops receiving and delivering new messages,
+// and waits until the messages already delivered to the output channels are acked or nacked, or ctx is done.
+// Then it closes the `Subscriber` like Close, so the messages that are still in flight are nacked.
+//
+// Receiving messages from Pub/Sub stops once draining starts. Messages that were already received,
+// but not delivered to the output channels yet, are nacked, so they are redelivered.
+// It returns how many of the messages in flight were drained, and how many were nacked.
+func (s *Subscriber) CloseWithContext(ctx context.Context) (CloseSummary, error) {
+	if s.getClosed() {
+		return CloseSummary{}, nil
+	}
+
+	s.logger.Info("Draining Google Cloud PubSub subscriber", nil)
+
+	select {
+	case <-s.inFlight.drain():
+		s.logger.Debug("All messages in flight were acked or nacked", nil)
+	case <-ctx.Done():
+		s.logger.Info("Draining deadline exceeded, nacking messages in flight", nil)
+	}
+
+	err := s.Close()
+
+	summary := s.inFlight.closeSummary()
+	s.logger.Info("Google Cloud PubSub subscriber drained", watermill.LogFields{
+		"drained": summary.Drained,
+		"nacked":  summary.Nacked,
+	})
+
+	return summary, err
+}
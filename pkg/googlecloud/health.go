@@ -0,0 +1,345 @@
+package googlecloud
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+)
+
+// HealthChecker reports if a component is alive and ready to work.
+// It's implemented by `Publisher`, `Subscriber` and their health reports.
+type HealthChecker interface {
+	// Live returns an error if the component can't recover without restarting the application.
+	Live() error
+	// Ready returns an error if the component can't work right now.
+	Ready() error
+}
+
+// SubscriptionState is the state of receiving messages from a subscription.
+type SubscriptionState string
+
+const (
+	// SubscriptionReceiving means the messages are received from the subscription.
+	SubscriptionReceiving SubscriptionState = "receiving"
+	// SubscriptionRetrying means receiving messages failed and is being retried.
+	// The subscription is receiving again once a retry runs for a while without failing.
+	SubscriptionRetrying SubscriptionState = "retrying"
+	// SubscriptionStopped means the messages are no longer received, because the subscription was unsubscribed,
+	// the `Subscriber` was closed, or receiving failed with a permanent error.
+	SubscriptionStopped SubscriptionState = "stopped"
+)
+
+// SubscriptionHealth is the state of a single Subscribe call.
+type SubscriptionHealth struct {
+	Topic            string
+	SubscriptionName string
+	State            SubscriptionState
+	// Since is when the subscription entered State.
+	Since time.Time
+	// LastError is the last error receiving messages failed with.
+	// For a stopped subscription, it's the error that stopped it, or nil if it was stopped on purpose.
+	LastError error
+	// Attempt is the number of the last attempt to receive messages that failed.
+	Attempt int
+}
+
+// SubscriberHealth is the state of the `Subscriber` and of its subscriptions.
+type SubscriberHealth struct {
+	Closed bool
+	// Subscriptions are sorted by topic and subscription name.
+	// A stopped subscription is reported until the subscription is used by Subscribe again.
+	Subscriptions []SubscriptionHealth
+}
+
+// Live returns an error if a subscription stopped because of an error.
+func (h SubscriberHealth) Live() error {
+	var err error
+	for _, sub := range h.Subscriptions {
+		if sub.State == SubscriptionStopped && sub.LastError != nil {
+			err = multierror.Append(err, errors.Wrapf(sub.LastError, "subscription %s stopped", sub.SubscriptionName))
+		}
+	}
+
+	return err
+}
+
+// Ready returns an error if the `Subscriber` is closed or a subscription is not receiving messages
+// because of an error.
+func (h SubscriberHealth) Ready() error {
+	if h.Closed {
+		return ErrSubscriberClosed
+	}
+
+	err := h.Live()
+	for _, sub := range h.Subscriptions {
+		if sub.State == SubscriptionRetrying {
+			err = multierror.Append(err, errors.Wrapf(
+				sub.LastError,
+				"subscription %s is retrying (attempt %d)", sub.SubscriptionName, sub.Attempt,
+			))
+		}
+	}
+
+	return err
+}
+
+// subscriptionsHealth tracks the state of the subscriptions of the `Subscriber`.
+type subscriptionsHealth struct {
+	lock          sync.Mutex
+	subscriptions map[*subscriptionConsumer]*SubscriptionHealth
+}
+
+func newSubscriptionsHealth() *subscriptionsHealth {
+	return &subscriptionsHealth{
+		subscriptions: map[*subscriptionConsumer]*SubscriptionHealth{},
+	}
+}
+
+// started registers the consumer as receiving.
+// The stopped consumers of the same subscription are forgotten.
+func (h *subscriptionsHealth) started(consumer *subscriptionConsumer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for c, sub := range h.subscriptions {
+		if sub.SubscriptionName == consumer.subscriptionName && sub.State == SubscriptionStopped {
+			delete(h.subscriptions, c)
+		}
+	}
+
+	h.subscriptions[consumer] = &SubscriptionHealth{
+		Topic:            consumer.topic,
+		SubscriptionName: consumer.subscriptionName,
+		State:            SubscriptionReceiving,
+		Since:            time.Now(),
+	}
+}
+
+// established marks the consumer as receiving again, unless the attempt already failed.
+func (h *subscriptionsHealth) established(consumer *subscriptionConsumer, attempt int) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	sub, ok := h.subscriptions[consumer]
+	if !ok || sub.State != SubscriptionRetrying || sub.Attempt >= attempt {
+		return
+	}
+
+	sub.State = SubscriptionReceiving
+	sub.Since = time.Now()
+}
+
+func (h *subscriptionsHealth) retrying(consumer *subscriptionConsumer, err error, attempt int) {
+	h.update(consumer, SubscriptionRetrying, func(sub *SubscriptionHealth) {
+		sub.LastError = err
+		sub.Attempt = attempt
+	})
+}
+
+// stopped marks the consumer as stopped. err is nil if it was stopped on purpose.
+func (h *subscriptionsHealth) stopped(consumer *subscriptionConsumer, err error) {
+	h.update(consumer, SubscriptionStopped, func(sub *SubscriptionHealth) {
+		sub.LastError = err
+	})
+}
+
+func (h *subscriptionsHealth) update(consumer *subscriptionConsumer, state SubscriptionState, fn func(sub *SubscriptionHealth)) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	sub, ok := h.subscriptions[consumer]
+	if !ok {
+		return
+	}
+
+	if sub.State != state {
+		sub.State = state
+		sub.Since = time.Now()
+	}
+	fn(sub)
+}
+
+func (h *subscriptionsHealth) report() []SubscriptionHealth {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	subscriptions := make([]SubscriptionHealth, 0, len(h.subscriptions))
+	for _, sub := range h.subscriptions {
+		subscriptions = append(subscriptions, *sub)
+	}
+	sort.Slice(subscriptions, func(i, j int) bool {
+		if subscriptions[i].Topic != subscriptions[j].Topic {
+			return subscriptions[i].Topic < subscriptions[j].Topic
+		}
+		return subscriptions[i].SubscriptionName < subscriptions[j].SubscriptionName
+	})
+
+	return subscriptions
+}
+
+// Health returns the state of the `Subscriber` and of the subscriptions made with Subscribe.
+func (s *Subscriber) Health() SubscriberHealth {
+	return SubscriberHealth{
+		Closed:        s.getClosed(),
+		Subscriptions: s.health.report(),
+	}
+}
+
+// Live returns an error if a subscription stopped because of an error.
+func (s *Subscriber) Live() error {
+	return s.Health().Live()
+}
+
+// Ready returns an error if the `Subscriber` is closed or a subscription is not receiving messages
+// because of an error.
+func (s *Subscriber) Ready() error {
+	return s.Health().Ready()
+}
+
+// TopicPublishHealth is the state of publishing to a topic.
+type TopicPublishHealth struct {
+	// LastPublishedAt is when a message was last published to the topic successfully.
+	LastPublishedAt time.Time
+	// LastError is the error the last failed publish returned.
+	LastError error
+	// LastErrorAt is when the last publish failed.
+	LastErrorAt time.Time
+	// Failing is true if the last publish to the topic failed within PublisherConfig.HealthErrorWindow.
+	Failing bool
+}
+
+// PublisherHealth is the state of the `Publisher` and of the topics it published to.
+type PublisherHealth struct {
+	Closed bool
+	Topics map[string]TopicPublishHealth
+}
+
+// Live never returns an error, because `Publisher` recovers from failed publishes.
+func (h PublisherHealth) Live() error {
+	return nil
+}
+
+// Ready returns an error if the `Publisher` is closed or the last publish to a topic failed recently.
+func (h PublisherHealth) Ready() error {
+	if h.Closed {
+		return ErrPublisherClosed
+	}
+
+	topics := make([]string, 0, len(h.Topics))
+	for topic := range h.Topics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	var err error
+	for _, topic := range topics {
+		if topicHealth := h.Topics[topic]; topicHealth.Failing {
+			err = multierror.Append(err, errors.Wrapf(topicHealth.LastError, "publishing to topic %s failed", topic))
+		}
+	}
+
+	return err
+}
+
+// publishHealth tracks the results of publishing to the topics.
+type publishHealth struct {
+	lock   sync.Mutex
+	topics map[string]TopicPublishHealth
+}
+
+func newPublishHealth() *publishHealth {
+	return &publishHealth{
+		topics: map[string]TopicPublishHealth{},
+	}
+}
+
+func (h *publishHealth) published(topic string, err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	topicHealth := h.topics[topic]
+	if err != nil {
+		topicHealth.LastError = err
+		topicHealth.LastErrorAt = time.Now()
+	} else {
+		topicHealth.LastPublishedAt = time.Now()
+	}
+	h.topics[topic] = topicHealth
+}
+
+// report returns the state of the topics. A topic is failing if the last publish failed within errorWindow.
+func (h *publishHealth) report(errorWindow time.Duration) map[string]TopicPublishHealth {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	topics := make(map[string]TopicPublishHealth, len(h.topics))
+	for topic, topicHealth := range h.topics {
+		topicHealth.Failing = topicHealth.LastError != nil &&
+			!topicHealth.LastErrorAt.Before(topicHealth.LastPublishedAt) &&
+			time.Since(topicHealth.LastErrorAt) < errorWindow
+		topics[topic] = topicHealth
+	}
+
+	return topics
+}
+
+// Health returns the state of the `Publisher` and of the topics it published to.
+func (p *Publisher) Health() PublisherHealth {
+	p.closedLock.RLock()
+	closed := p.closed
+	p.closedLock.RUnlock()
+
+	return PublisherHealth{
+		Closed: closed,
+		Topics: p.health.report(p.config.HealthErrorWindow),
+	}
+}
+
+// Live never returns an error, because `Publisher` recovers from failed publishes.
+func (p *Publisher) Live() error {
+	return p.Health().Live()
+}
+
+// Ready returns an error if the `Publisher` is closed or the last publish to a topic failed recently.
+func (p *Publisher) Ready() error {
+	return p.Health().Ready()
+}
+
+// NewLivenessHandler returns an http.Handler for liveness probes.
+// It responds with 200 OK if all checkers are alive, and with 503 Service Unavailable and the errors otherwise.
+func NewLivenessHandler(checkers ...HealthChecker) http.Handler {
+	return healthHandler(checkers, HealthChecker.Live)
+}
+
+// NewReadinessHandler returns an http.Handler for readiness probes.
+// It responds with 200 OK if all checkers are ready, and with 503 Service Unavailable and the errors otherwise.
+func NewReadinessHandler(checkers ...HealthChecker) http.Handler {
+	return healthHandler(checkers, HealthChecker.Ready)
+}
+
+func healthHandler(checkers []HealthChecker, check func(HealthChecker) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var failures []string
+		for _, checker := range checkers {
+			if err := check(checker); err != nil {
+				failures = append(failures, err.Error())
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if len(failures) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = fmt.Fprintln(w, strings.Join(failures, "\n"))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintln(w, "ok")
+	})
+}
@@ -1,6 +1,9 @@
 package googlecloud
 
 import (
+	"context"
+	"strconv"
+
 	"cloud.google.com/go/pubsub"
 	"github.com/pkg/errors"
 
@@ -12,6 +15,21 @@ type Marshaler interface {
 	Marshal(topic string, msg *message.Message) (*pubsub.Message, error)
 }
 
+// ContextMarshaler is an optional interface that may be implemented by a Marshaler.
+// If implemented, the Publisher calls MarshalWithContext with the context of the publish call instead of Marshal,
+// so values like trace information can be carried into the Google Cloud client library Message.
+type ContextMarshaler interface {
+	MarshalWithContext(ctx context.Context, topic string, msg *message.Message) (*pubsub.Message, error)
+}
+
+func marshal(ctx context.Context, marshaler Marshaler, topic string, msg *message.Message) (*pubsub.Message, error) {
+	if contextMarshaler, ok := marshaler.(ContextMarshaler); ok {
+		return contextMarshaler.MarshalWithContext(ctx, topic, msg)
+	}
+
+	return marshaler.Marshal(topic, msg)
+}
+
 // Unmarshaler transforms a Google Cloud client library Message into the Waterfall Message.
 type Unmarshaler interface {
 	Unmarshal(*pubsub.Message) (*message.Message, error)
@@ -24,6 +42,10 @@ const UUIDHeaderKey = "_watermill_message_uuid"
 // This ID is assigned by the server when the message is published and is guaranteed to be unique within the topic.
 const GoogleMessageIDHeaderKey = "_watermill_message_google_message_id"
 
+// DeliveryAttemptHeaderKey is the key of the metadata that carries the number of times Pub/Sub attempted to deliver the message.
+// It is set only if the subscription has a dead-letter policy, otherwise Pub/Sub does not count delivery attempts.
+const DeliveryAttemptHeaderKey = "_watermill_message_google_delivery_attempt"
+
 // DefaultMarshalerUnmarshaler implements Marshaler and Unmarshaler in the following way:
 // All Google Cloud Pub/Sub attributes are equivalent to Waterfall Message metadata.
 // Waterfall Message UUID is equivalent to an attribute with `UUIDHeaderKey` as key.
@@ -69,6 +91,9 @@ func (DefaultMarshalerUnmarshaler) Unmarshal(pubsubMsg *pubsub.Message) (*messag
 
 	metadata.Set("publishTime", pubsubMsg.PublishTime.String())
 	metadata.Set(GoogleMessageIDHeaderKey, pubsubMsg.ID)
+	if pubsubMsg.DeliveryAttempt != nil {
+		metadata.Set(DeliveryAttemptHeaderKey, strconv.Itoa(*pubsubMsg.DeliveryAttempt))
+	}
 
 	msg := message.NewMessage(id, pubsubMsg.Data)
 	msg.Metadata = metadata
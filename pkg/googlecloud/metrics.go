@@ -0,0 +1,212 @@
+package googlecloud
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// Metrics receives the measurements of Publisher and Subscriber.
+// The implementation must be safe for concurrent use.
+type Metrics interface {
+	// MessagePublished is called when publishing a message finished, with the time it took and the error, if it failed.
+	MessagePublished(ctx context.Context, topic string, duration time.Duration, err error)
+
+	// ReceiveRestarted is called when receiving messages failed and is going to be retried.
+	ReceiveRestarted(ctx context.Context, topic, subscription string, err error)
+
+	// MessageReceived is called when a message is received, with the time since it was published.
+	// deliveryAttempt is 0 if it's unknown, which happens when the subscription has no dead-letter policy.
+	MessageReceived(ctx context.Context, topic, subscription string, endToEndLatency time.Duration, deliveryAttempt int)
+
+	// MessageAcked is called when a message is acked, with the time since it was received.
+	MessageAcked(ctx context.Context, topic, subscription string, timeToAck time.Duration)
+
+	// MessageNacked is called when a message is nacked, with the time since it was received.
+	MessageNacked(ctx context.Context, topic, subscription string, timeToNack time.Duration)
+}
+
+// NoopMetrics is a Metrics implementation that does nothing. It's used by default.
+type NoopMetrics struct{}
+
+func (NoopMetrics) MessagePublished(ctx context.Context, topic string, duration time.Duration, err error) {
+}
+
+func (NoopMetrics) ReceiveRestarted(ctx context.Context, topic, subscription string, err error) {}
+
+func (NoopMetrics) MessageReceived(ctx context.Context, topic, subscription string, endToEndLatency time.Duration, deliveryAttempt int) {
+}
+
+func (NoopMetrics) MessageAcked(ctx context.Context, topic, subscription string, timeToAck time.Duration) {
+}
+
+func (NoopMetrics) MessageNacked(ctx context.Context, topic, subscription string, timeToNack time.Duration) {
+}
+
+// meterName is the name of the OpenTelemetry meter used by OpenTelemetryMetrics.
+const meterName = tracerName
+
+// OpenTelemetryMetrics records the measurements with OpenTelemetry instruments.
+// The instruments are labeled with the topic (messaging.destination.name)
+// and the subscription (messaging.destination.subscription.name).
+type OpenTelemetryMetrics struct {
+	publishDuration metric.Float64Histogram
+	publishFailures metric.Int64Counter
+	receiveRestarts metric.Int64Counter
+	received        metric.Int64Counter
+	redelivered     metric.Int64Counter
+	endToEndLatency metric.Float64Histogram
+	acked           metric.Int64Counter
+	nacked          metric.Int64Counter
+	ackNackDuration metric.Float64Histogram
+}
+
+// NewOpenTelemetryMetrics creates the instruments with the meterProvider.
+// If meterProvider is nil, the global MeterProvider is used.
+func NewOpenTelemetryMetrics(meterProvider metric.MeterProvider) (*OpenTelemetryMetrics, error) {
+	if meterProvider == nil {
+		meterProvider = otel.GetMeterProvider()
+	}
+	meter := meterProvider.Meter(meterName)
+
+	m := &OpenTelemetryMetrics{}
+	var err error
+
+	if m.publishDuration, err = meter.Float64Histogram(
+		"watermill.googlecloud.publish.duration",
+		metric.WithDescription("Time it took to publish a message."),
+		metric.WithUnit("s"),
+	); err != nil {
+		return nil, errors.Wrap(err, "could not create publish duration histogram")
+	}
+	if m.publishFailures, err = meter.Int64Counter(
+		"watermill.googlecloud.publish.failures",
+		metric.WithDescription("Number of messages that could not be published."),
+		metric.WithUnit("{message}"),
+	); err != nil {
+		return nil, errors.Wrap(err, "could not create publish failures counter")
+	}
+	if m.receiveRestarts, err = meter.Int64Counter(
+		"watermill.googlecloud.receive.restarts",
+		metric.WithDescription("Number of times receiving messages failed and was retried."),
+		metric.WithUnit("{restart}"),
+	); err != nil {
+		return nil, errors.Wrap(err, "could not create receive restarts counter")
+	}
+	if m.received, err = meter.Int64Counter(
+		"watermill.googlecloud.messages.received",
+		metric.WithDescription("Number of received messages."),
+		metric.WithUnit("{message}"),
+	); err != nil {
+		return nil, errors.Wrap(err, "could not create received messages counter")
+	}
+	if m.redelivered, err = meter.Int64Counter(
+		"watermill.googlecloud.messages.redelivered",
+		metric.WithDescription("Number of received messages with a delivery attempt greater than 1."),
+		metric.WithUnit("{message}"),
+	); err != nil {
+		return nil, errors.Wrap(err, "could not create redelivered messages counter")
+	}
+	if m.endToEndLatency, err = meter.Float64Histogram(
+		"watermill.googlecloud.message.latency",
+		metric.WithDescription("Time between publishing and receiving a message."),
+		metric.WithUnit("s"),
+	); err != nil {
+		return nil, errors.Wrap(err, "could not create end-to-end latency histogram")
+	}
+	if m.acked, err = meter.Int64Counter(
+		"watermill.googlecloud.messages.acked",
+		metric.WithDescription("Number of acked messages."),
+		metric.WithUnit("{message}"),
+	); err != nil {
+		return nil, errors.Wrap(err, "could not create acked messages counter")
+	}
+	if m.nacked, err = meter.Int64Counter(
+		"watermill.googlecloud.messages.nacked",
+		metric.WithDescription("Number of nacked messages."),
+		metric.WithUnit("{message}"),
+	); err != nil {
+		return nil, errors.Wrap(err, "could not create nacked messages counter")
+	}
+	if m.ackNackDuration, err = meter.Float64Histogram(
+		"watermill.googlecloud.message.ack_duration",
+		metric.WithDescription("Time between receiving a message and acking or nacking it."),
+		metric.WithUnit("s"),
+	); err != nil {
+		return nil, errors.Wrap(err, "could not create ack duration histogram")
+	}
+
+	return m, nil
+}
+
+func topicAttributes(topic string) metric.MeasurementOption {
+	return metric.WithAttributes(semconv.MessagingDestinationName(topic))
+}
+
+func subscriptionAttributes(topic, subscription string, kvs ...attribute.KeyValue) metric.MeasurementOption {
+	return metric.WithAttributes(append([]attribute.KeyValue{
+		semconv.MessagingDestinationName(topic),
+		messagingDestinationSubscriptionNameKey.String(subscription),
+	}, kvs...)...)
+}
+
+func (m *OpenTelemetryMetrics) MessagePublished(ctx context.Context, topic string, duration time.Duration, err error) {
+	m.publishDuration.Record(ctx, duration.Seconds(), topicAttributes(topic))
+	if err != nil {
+		m.publishFailures.Add(ctx, 1, topicAttributes(topic))
+	}
+}
+
+func (m *OpenTelemetryMetrics) ReceiveRestarted(ctx context.Context, topic, subscription string, err error) {
+	m.receiveRestarts.Add(ctx, 1, subscriptionAttributes(topic, subscription))
+}
+
+func (m *OpenTelemetryMetrics) MessageReceived(ctx context.Context, topic, subscription string, endToEndLatency time.Duration, deliveryAttempt int) {
+	m.received.Add(ctx, 1, subscriptionAttributes(topic, subscription))
+	m.endToEndLatency.Record(ctx, endToEndLatency.Seconds(), subscriptionAttributes(topic, subscription))
+	if deliveryAttempt > 1 {
+		m.redelivered.Add(ctx, 1, subscriptionAttributes(topic, subscription))
+	}
+}
+
+func (m *OpenTelemetryMetrics) MessageAcked(ctx context.Context, topic, subscription string, timeToAck time.Duration) {
+	m.acked.Add(ctx, 1, subscriptionAttributes(topic, subscription))
+	m.ackNackDuration.Record(ctx, timeToAck.Seconds(), subscriptionAttributes(topic, subscription, attribute.Bool("acked", true)))
+}
+
+func (m *OpenTelemetryMetrics) MessageNacked(ctx context.Context, topic, subscription string, timeToNack time.Duration) {
+	m.nacked.Add(ctx, 1, subscriptionAttributes(topic, subscription))
+	m.ackNackDuration.Record(ctx, timeToNack.Seconds(), subscriptionAttributes(topic, subscription, attribute.Bool("acked", false)))
+}
+
+// subscriptionMetrics reports the measurements of a single subscription.
+type subscriptionMetrics struct {
+	metrics          Metrics
+	topic            string
+	subscriptionName string
+}
+
+// received reports the received message, and returns a function reporting it was acked or nacked.
+func (m subscriptionMetrics) received(ctx context.Context, pubsubMsg *pubsub.Message) func(acked bool) {
+	receivedAt := time.Now()
+
+	deliveryAttempt := 0
+	if pubsubMsg.DeliveryAttempt != nil {
+		deliveryAttempt = *pubsubMsg.DeliveryAttempt
+	}
+	m.metrics.MessageReceived(ctx, m.topic, m.subscriptionName, receivedAt.Sub(pubsubMsg.PublishTime), deliveryAttempt)
+
+	return func(acked bool) {
+		if acked {
+			m.metrics.MessageAcked(ctx, m.topic, m.subscriptionName, time.Since(receivedAt))
+		} else {
+			m.metrics.MessageNacked(ctx, m.topic, m.subscriptionName, time.Since(receivedAt))
+		}
+	}
+}
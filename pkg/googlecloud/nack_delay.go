@@ -0,0 +1,77 @@
+package googlecloud
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// NackDelayFn returns how long the Subscriber holds a nacked message before nacking it in Pub/Sub,
+// so it is not redelivered immediately.
+//
+// deliveryAttempt is the number of times Pub/Sub attempted to deliver the message, starting from 1.
+// Pub/Sub counts delivery attempts only if the subscription has a dead-letter policy (see SubscriberConfig.DeadLetter),
+// otherwise deliveryAttempt is always 1.
+type NackDelayFn func(msg *message.Message, deliveryAttempt int) time.Duration
+
+// FixedNackDelay holds every nacked message for the same delay.
+func FixedNackDelay(delay time.Duration) NackDelayFn {
+	return func(msg *message.Message, deliveryAttempt int) time.Duration {
+		return delay
+	}
+}
+
+// ExponentialNackDelay holds a nacked message for initial delay, doubled with every delivery attempt, up to max.
+func ExponentialNackDelay(initial, max time.Duration) NackDelayFn {
+	return func(msg *message.Message, deliveryAttempt int) time.Duration {
+		delay := initial
+		for i := 1; i < deliveryAttempt && delay < max; i++ {
+			delay *= 2
+		}
+		if delay > max {
+			return max
+		}
+		return delay
+	}
+}
+
+// holdNackedMessage waits for the delay returned by NackDelay before the message is nacked.
+// The client library keeps extending the ack deadline of the held message, up to ReceiveSettings.MaxExtension,
+// so the delay is capped to it.
+func (s *Subscriber) holdNackedMessage(ctx context.Context, pubsubMsg *pubsub.Message, msg *message.Message, logFields watermill.LogFields) {
+	if s.config.NackDelay == nil {
+		return
+	}
+
+	deliveryAttempt := 1
+	if pubsubMsg.DeliveryAttempt != nil {
+		deliveryAttempt = *pubsubMsg.DeliveryAttempt
+	}
+
+	delay := s.config.NackDelay(msg, deliveryAttempt)
+	if maxExtension := s.config.maxAckExtension(); maxExtension > 0 && delay > maxExtension {
+		delay = maxExtension
+	}
+	if delay <= 0 {
+		return
+	}
+
+	s.logger.Trace("Holding nacked message", logFields.Add(watermill.LogFields{
+		"delay":            delay,
+		"delivery_attempt": deliveryAttempt,
+	}))
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-s.closing:
+	case <-s.inFlight.Draining():
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,47 @@
+package googlecloud
+
+import (
+	"context"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// PublishResult is the result of publishing a single message with Publisher.PublishAsync.
+type PublishResult struct {
+	// Message is the published message.
+	// When the message is published successfully, GoogleMessageIDHeaderKey is set in its metadata before Ready is closed.
+	Message *message.Message
+
+	ready           chan struct{}
+	serverMessageID string
+	err             error
+}
+
+func newPublishResult(msg *message.Message) *PublishResult {
+	return &PublishResult{
+		Message: msg,
+		ready:   make(chan struct{}),
+	}
+}
+
+// Ready returns a channel that is closed when the result is available.
+func (r *PublishResult) Ready() <-chan struct{} {
+	return r.ready
+}
+
+// Get blocks until the message is published or ctx is done.
+// It returns the server-generated message ID, or the error that occurred while publishing the message.
+func (r *PublishResult) Get(ctx context.Context) (serverMessageID string, err error) {
+	select {
+	case <-r.ready:
+		return r.serverMessageID, r.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (r *PublishResult) set(serverMessageID string, err error) {
+	r.serverMessageID = serverMessageID
+	r.err = err
+	close(r.ready)
+}
@@ -6,7 +6,9 @@ import (
 	"time"
 
 	"cloud.google.com/go/pubsub"
+	"github.com/hashicorp/go-multierror"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/api/option"
 
 	"github.com/ThreeDotsLabs/watermill"
@@ -25,10 +27,23 @@ var (
 type Publisher struct {
 	topics     map[string]*pubsub.Topic
 	topicsLock sync.RWMutex
+	// topicsStopped is set by Close once the topics are stopped, so no new topic is cached after that.
+	topicsStopped bool
+
 	closed     bool
+	closedLock sync.RWMutex
+	closeOnce  sync.Once
+	closeErr   error
+
+	// inFlight tracks the Publish calls and the results of PublishAsync that are not resolved yet.
+	inFlight sync.WaitGroup
 
 	client *pubsub.Client
-	config PublisherConfig
+	tracer *publishTracer
+	health *publishHealth
+	// ownsClient is true if the client was created by the Publisher, so it's closed with it.
+	ownsClient bool
+	config     PublisherConfig
 
 	logger watermill.LoggerAdapter
 }
@@ -43,7 +58,8 @@ type PublisherConfig struct {
 	// If false (default), `Publisher` tries to create a topic if there is none with the requested name.
 	// Otherwise, trying to subscribe to non-existent subscription results in `ErrTopicDoesNotExist`.
 	DoNotCreateTopicIfMissing bool
-	// Enables the topic message ordering
+	// Enables the topic message ordering.
+	// Not used if TopicSettingsFn is set.
 	EnableMessageOrdering bool
 	// Enables automatic resume publish upon error
 	EnableMessageOrderingAutoResumePublishOnError bool
@@ -52,15 +68,77 @@ type PublisherConfig struct {
 	ConnectTimeout time.Duration
 	// PublishTimeout defines the timeout for publishing messages.
 	PublishTimeout time.Duration
+	// CloseTimeout defines how long Close waits for the Publish calls in progress before it stops the topics.
+	// Messages published after the timeout fail. By default, Close waits for 30 seconds.
+	CloseTimeout time.Duration
 
 	// Settings for cloud.google.com/go/pubsub client library.
+	// PublishSettings are not used if TopicSettingsFn is set.
 	PublishSettings *pubsub.PublishSettings
 	ClientOptions   []option.ClientOption
 
+	// Client, if set, is used instead of creating a client. ClientOptions are not used for it.
+	// The client is owned by the caller, so `Publisher` doesn't close it.
+	// If ProjectID is empty, the project of the client is used.
+	Client *pubsub.Client
+	// ClientPool, if set, provides the client of ProjectID.
+	// It may be shared with other Publishers and Subscribers. `Publisher` doesn't close its clients.
+	//
+	// Only one of Client and ClientPool may be set.
+	ClientPool *ClientPool
+
+	// TopicConfig is used to create topics that don't exist yet.
+	// It is not used if TopicConfigFn is set.
+	TopicConfig pubsub.TopicConfig
+	// TopicConfigFn returns the config used to create a topic that doesn't exist yet.
+	// By default, TopicConfig is used for all topics.
+	TopicConfigFn TopicConfigFn
+
+	// TopicSettingsFn returns the settings applied to a topic when the Publisher uses it for the first time.
+	// It allows using different publish settings and message ordering for different topics.
+	// By default, PublishSettings and EnableMessageOrdering are used for all topics.
+	TopicSettingsFn TopicSettingsFn
+
 	Marshaler Marshaler
+
+	// Tracing, if set, enables OpenTelemetry tracing of published messages.
+	// The trace context of the publish span is injected into the attributes produced by the Marshaler.
+	Tracing *TracingConfig
+	// Metrics receives the measurements of published messages.
+	// By default, NoopMetrics is used. Use NewOpenTelemetryMetrics to record them with OpenTelemetry.
+	Metrics Metrics
+
+	// HealthErrorWindow defines how long a failed publish to a topic makes the `Publisher` not ready,
+	// unless a later publish to the topic succeeds. By default, it's a minute.
+	HealthErrorWindow time.Duration
 }
 
+// TopicSettings are the client library settings of a single topic used by the Publisher.
+type TopicSettings struct {
+	// PublishSettings are used for the topic if not nil, otherwise the client library defaults are used.
+	PublishSettings *pubsub.PublishSettings
+	// EnableMessageOrdering enables the message ordering for the topic.
+	EnableMessageOrdering bool
+}
+
+type TopicSettingsFn func(topic string) TopicSettings
+
 func (c *PublisherConfig) setDefaults() {
+	if c.ProjectID == "" && c.Client != nil {
+		c.ProjectID = c.Client.Project()
+	}
+	if c.TopicConfigFn == nil {
+		c.TopicConfigFn = staticTopicConfig(c.TopicConfig)
+	}
+	if c.TopicSettingsFn == nil {
+		settings := TopicSettings{
+			PublishSettings:       c.PublishSettings,
+			EnableMessageOrdering: c.EnableMessageOrdering,
+		}
+		c.TopicSettingsFn = func(topic string) TopicSettings {
+			return settings
+		}
+	}
 	if c.Marshaler == nil {
 		c.Marshaler = DefaultMarshalerUnmarshaler{}
 	}
@@ -70,10 +148,43 @@ func (c *PublisherConfig) setDefaults() {
 	if c.PublishTimeout == 0 {
 		c.PublishTimeout = time.Second * 5
 	}
+	if c.CloseTimeout == 0 {
+		c.CloseTimeout = time.Second * 30
+	}
+	if c.HealthErrorWindow == 0 {
+		c.HealthErrorWindow = time.Minute
+	}
+	if c.Metrics == nil {
+		c.Metrics = NoopMetrics{}
+	}
+	if c.Tracing != nil {
+		tracing := *c.Tracing
+		tracing.setDefaults()
+		c.Tracing = &tracing
+	}
+}
+
+func (c PublisherConfig) topicProvisioner(logger watermill.LoggerAdapter) topicProvisioner {
+	return topicProvisioner{
+		doNotCreateTopicIfMissing: c.DoNotCreateTopicIfMissing,
+		topicConfigFn:             c.TopicConfigFn,
+		logger:                    logger,
+	}
+}
+
+func (c PublisherConfig) validate() error {
+	if c.Client != nil && c.ClientPool != nil {
+		return errors.New("only one of Client and ClientPool may be set")
+	}
+
+	return nil
 }
 
 func NewPublisher(config PublisherConfig, logger watermill.LoggerAdapter) (*Publisher, error) {
 	config.setDefaults()
+	if err := config.validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid config")
+	}
 
 	if logger == nil {
 		logger = watermill.NopLogger{}
@@ -81,10 +192,17 @@ func NewPublisher(config PublisherConfig, logger watermill.LoggerAdapter) (*Publ
 
 	pub := &Publisher{
 		topics: map[string]*pubsub.Topic{},
+		tracer: newPublishTracer(config.Tracing),
+		health: newPublishHealth(),
 		config: config,
 		logger: logger,
 	}
 
+	if config.Client != nil {
+		pub.client = config.Client
+		return pub, nil
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), config.ConnectTimeout)
 	defer cancel()
 
@@ -100,6 +218,7 @@ func NewPublisher(config PublisherConfig, logger watermill.LoggerAdapter) (*Publ
 	case err = <-errc:
 		return nil, err
 	}
+	pub.ownsClient = config.ClientPool == nil
 
 	return pub, nil
 }
@@ -113,7 +232,13 @@ func connect(ctx context.Context, config PublisherConfig) (<-chan *pubsub.Client
 		defer close(errc)
 
 		// blocking
-		c, err := pubsub.NewClient(context.Background(), config.ProjectID, config.ClientOptions...)
+		var c *pubsub.Client
+		var err error
+		if config.ClientPool != nil {
+			c, err = config.ClientPool.Client(context.Background(), config.ProjectID)
+		} else {
+			c, err = pubsub.NewClient(context.Background(), config.ProjectID, config.ClientOptions...)
+		}
 		if err != nil {
 			errc <- err
 			return
@@ -133,74 +258,238 @@ func connect(ctx context.Context, config PublisherConfig) (<-chan *pubsub.Client
 // Publish publishes a set of messages on a Google Cloud Pub/Sub topic.
 // It blocks until all the messages are successfully published or an error occurred.
 //
+// All messages are marshaled and handed over to the client library before any result is awaited,
+// so they can be bundled into as few requests as possible.
+// If some of the messages could not be published, the returned error contains an entry for each of them.
+//
 // To receive messages published to a topic, you must create a subscription to that topic.
 // Only messages published to the topic after the subscription is created are available to subscriber applications.
 //
 // See https://cloud.google.com/pubsub/docs/publisher to find out more about how Google Cloud Pub/Sub Publishers work.
 func (p *Publisher) Publish(topic string, messages ...*message.Message) error {
-	if p.closed {
+	return p.PublishWithContext(context.Background(), topic, messages...)
+}
+
+// PublishWithContext works like Publish, but uses the provided context for checking and creating the topic
+// and for waiting for the results.
+// PublishTimeout is still applied as an upper bound, so the context's deadline is only used if it is earlier.
+//
+// If the configured Marshaler implements ContextMarshaler, the context is passed to it,
+// so values like trace information can be carried into the published message.
+func (p *Publisher) PublishWithContext(ctx context.Context, topic string, messages ...*message.Message) error {
+	if !p.startPublish() {
 		return ErrPublisherClosed
 	}
+	defer p.inFlight.Done()
 
-	ctx, cancel := context.WithTimeout(context.Background(), p.config.PublishTimeout)
+	ctx, cancel := context.WithTimeout(ctx, p.config.PublishTimeout)
 	defer cancel()
 
-	t, err := p.topic(ctx, topic)
+	// The message IDs are set here rather than in the background,
+	// so the messages are not modified after PublishWithContext returned because ctx is done.
+	results, err := p.publish(ctx, topic, messages, false)
 	if err != nil {
 		return err
 	}
 
-	logFields := make(watermill.LogFields, 2)
-	logFields["topic"] = topic
+	var publishErr error
+	for _, result := range results {
+		serverMessageID, err := result.Get(ctx)
+		if err != nil {
+			publishErr = multierror.Append(publishErr, errors.Wrapf(err, "publishing message %s failed", result.Message.UUID))
+			continue
+		}
+		result.Message.Metadata.Set(GoogleMessageIDHeaderKey, serverMessageID)
+	}
 
-	for _, msg := range messages {
-		logFields["message_uuid"] = msg.UUID
-		p.logger.Trace("Sending message to Google PubSub", logFields)
+	return publishErr
+}
+
+// PublishAsync publishes a set of messages on a Google Cloud Pub/Sub topic without waiting for the results.
+// It returns one PublishResult per message, in the same order as the messages.
+//
+// The returned error is non-nil only if the messages could not be handed over to the client library,
+// for example because the topic does not exist or one of the messages could not be marshaled.
+// In that case none of the messages is published.
+//
+// Close waits for all the results returned by PublishAsync to be ready.
+func (p *Publisher) PublishAsync(ctx context.Context, topic string, messages ...*message.Message) ([]*PublishResult, error) {
+	if !p.startPublish() {
+		return nil, ErrPublisherClosed
+	}
+	defer p.inFlight.Done()
+
+	ctx, cancel := context.WithTimeout(ctx, p.config.PublishTimeout)
+	defer cancel()
+
+	return p.publish(ctx, topic, messages, true)
+}
+
+// startPublish registers a Publish call in inFlight, unless the Publisher is closed.
+// Once closed is set, inFlight is incremented only by the calls already registered, so Close can safely wait for it.
+func (p *Publisher) startPublish() bool {
+	p.closedLock.RLock()
+	defer p.closedLock.RUnlock()
+
+	if p.closed {
+		return false
+	}
+	p.inFlight.Add(1)
+
+	return true
+}
+
+// publish marshals the messages and hands them over to the client library.
+// The returned results are resolved in the background. If setMessageIDs is true,
+// GoogleMessageIDHeaderKey is set in the metadata of the published messages before their results are ready.
+func (p *Publisher) publish(ctx context.Context, topic string, messages []*message.Message, setMessageIDs bool) ([]*PublishResult, error) {
+	t, err := p.topic(ctx, topic)
+	if err != nil {
+		p.health.published(topic, err)
+		return nil, err
+	}
 
-		googlecloudMsg, err := p.config.Marshaler.Marshal(topic, msg)
+	googlecloudMsgs := make([]*pubsub.Message, len(messages))
+	for i, msg := range messages {
+		googlecloudMsg, err := marshal(ctx, p.config.Marshaler, topic, msg)
 		if err != nil {
-			return errors.Wrapf(err, "cannot marshal message %s", msg.UUID)
+			return nil, errors.Wrapf(err, "cannot marshal message %s", msg.UUID)
 		}
+		googlecloudMsgs[i] = googlecloudMsg
+	}
 
-		result := t.Publish(ctx, googlecloudMsg)
-		<-result.Ready()
+	results := make([]*PublishResult, len(messages))
+	for i, msg := range messages {
+		p.logger.Trace("Sending message to Google PubSub", watermill.LogFields{
+			"topic":        topic,
+			"message_uuid": msg.UUID,
+		})
+
+		result := newPublishResult(msg)
+		googlecloudMsg := googlecloudMsgs[i]
+		span := p.tracer.start(ctx, topic, msg, googlecloudMsg)
+		publishStart := time.Now()
+		pending := t.Publish(ctx, googlecloudMsg)
+		results[i] = result
+
+		// Every result is resolved as soon as it's ready, so a slow message doesn't delay the others,
+		// nor inflate their publish latency.
+		p.inFlight.Add(1)
+		go func() {
+			defer p.inFlight.Done()
+			p.resolvePublishResult(t, topic, googlecloudMsg, pending, publishStart, span, result, setMessageIDs)
+		}()
+	}
 
-		serverMessageID, err := result.Get(ctx)
-		if err != nil {
-			// https://cloud.google.com/pubsub/docs/samples/pubsub-resume-publish-with-ordering-key
-			if p.config.EnableMessageOrdering && p.config.EnableMessageOrderingAutoResumePublishOnError && googlecloudMsg.OrderingKey != "" {
-				// Resume publish on an ordering key that has had unrecoverable errors.
-				// After such an error publishes with this ordering key will fail
-				// until this method is called.
-				t.ResumePublish(googlecloudMsg.OrderingKey)
-			}
-			return errors.Wrapf(err, "publishing message %s failed", msg.UUID)
+	return results, nil
+}
+
+func (p *Publisher) resolvePublishResult(
+	t *pubsub.Topic,
+	topic string,
+	googlecloudMsg *pubsub.Message,
+	pending *pubsub.PublishResult,
+	publishStart time.Time,
+	span trace.Span,
+	result *PublishResult,
+	setMessageID bool,
+) {
+	logFields := watermill.LogFields{
+		"topic":        topic,
+		"message_uuid": result.Message.UUID,
+	}
+
+	<-pending.Ready()
+
+	serverMessageID, err := pending.Get(context.Background())
+	p.tracer.end(span, serverMessageID, err)
+	p.config.Metrics.MessagePublished(context.Background(), topic, time.Since(publishStart), err)
+	p.health.published(topic, err)
+	if err != nil {
+		// https://cloud.google.com/pubsub/docs/samples/pubsub-resume-publish-with-ordering-key
+		if t.EnableMessageOrdering && p.config.EnableMessageOrderingAutoResumePublishOnError && googlecloudMsg.OrderingKey != "" {
+			// Resume publish on an ordering key that has had unrecoverable errors.
+			// After such an error publishes with this ordering key will fail
+			// until this method is called.
+			t.ResumePublish(googlecloudMsg.OrderingKey)
 		}
 
-		msg.Metadata.Set(GoogleMessageIDHeaderKey, serverMessageID)
+		p.logger.Trace("Publishing message to Google PubSub failed", logFields)
+		result.set("", err)
+		return
+	}
 
-		p.logger.Trace("Message published to Google PubSub", logFields)
+	if setMessageID {
+		result.Message.Metadata.Set(GoogleMessageIDHeaderKey, serverMessageID)
 	}
+	p.logger.Trace("Message published to Google PubSub", logFields)
 
-	return nil
+	result.set(serverMessageID, nil)
 }
 
 // Close notifies the Publisher to stop processing messages, send all the remaining messages and close the connection.
+// A client passed with PublisherConfig.Client or PublisherConfig.ClientPool is left open.
+//
+// New messages are rejected with ErrPublisherClosed right away. Close waits for the Publish calls in progress
+// and for the results returned by PublishAsync up to CloseTimeout. Then it stops the topics, which flushes
+// the outstanding messages, so Close takes at most CloseTimeout plus the time it takes to flush them.
+// It's safe to call Close multiple times, also concurrently. All calls return the same error.
 func (p *Publisher) Close() error {
+	p.closeOnce.Do(func() {
+		p.closeErr = p.close()
+	})
+
+	return p.closeErr
+}
+
+func (p *Publisher) close() error {
 	p.logger.Info("Closing Google PubSub publisher", nil)
 	defer p.logger.Info("Google PubSub publisher closed", nil)
 
-	if p.closed {
-		return nil
-	}
+	p.closedLock.Lock()
 	p.closed = true
+	p.closedLock.Unlock()
+
+	inFlightDone := make(chan struct{})
+	go func() {
+		p.inFlight.Wait()
+		close(inFlightDone)
+	}()
+
+	timeout := time.NewTimer(p.config.CloseTimeout)
+	defer timeout.Stop()
+
+	timedOut := false
+	select {
+	case <-inFlightDone:
+	case <-timeout.C:
+		timedOut = true
+		p.logger.Info("Timeout waiting for messages in flight, stopping topics", nil)
+	}
 
 	p.topicsLock.Lock()
+	p.topicsStopped = true
 	for _, t := range p.topics {
 		t.Stop()
 	}
 	p.topicsLock.Unlock()
 
+	// Stopping the topics flushes all the outstanding messages, so the results are ready at this point.
+	// Publish calls that are still checking or creating a topic are not waited for after the timeout.
+	if timedOut {
+		select {
+		case <-inFlightDone:
+		default:
+			p.logger.Info("Messages still in flight, closing anyway", nil)
+		}
+	} else {
+		<-inFlightDone
+	}
+
+	if !p.ownsClient {
+		return nil
+	}
+
 	return p.client.Close()
 }
 
@@ -213,43 +502,29 @@ func (p *Publisher) topic(ctx context.Context, topic string) (t *pubsub.Topic, e
 	}
 
 	p.topicsLock.Lock()
+	if p.topicsStopped {
+		p.topicsLock.Unlock()
+		return nil, ErrPublisherClosed
+	}
+	if t, ok := p.topics[topic]; ok {
+		p.topicsLock.Unlock()
+		return t, nil
+	}
 	defer func() {
 		if err == nil {
-			t.EnableMessageOrdering = p.config.EnableMessageOrdering
+			settings := p.config.TopicSettingsFn(topic)
+			if settings.PublishSettings != nil {
+				t.PublishSettings = *settings.PublishSettings
+			}
+			t.EnableMessageOrdering = settings.EnableMessageOrdering
 			p.topics[topic] = t
 		}
 		p.topicsLock.Unlock()
 	}()
 
-	t = p.client.Topic(topic)
-
-	// todo: theoretically, one could want different publish settings per topic, which is supported by the client lib
-	// different instances of publisher may be used then
-	if p.config.PublishSettings != nil {
-		t.PublishSettings = *p.config.PublishSettings
-	}
-
 	if p.config.DoNotCheckTopicExistence {
-		return t, nil
-	}
-
-	exists, err := t.Exists(ctx)
-	if err != nil {
-		return nil, errors.Wrapf(err, "could not check if topic %s exists", topic)
-	}
-
-	if exists {
-		return t, nil
-	}
-
-	if p.config.DoNotCreateTopicIfMissing {
-		return nil, errors.Wrap(ErrTopicDoesNotExist, topic)
-	}
-
-	t, err = p.client.CreateTopic(ctx, topic)
-	if err != nil {
-		return nil, errors.Wrapf(err, "could not create topic %s", topic)
+		return p.client.Topic(topic), nil
 	}
 
-	return t, nil
+	return p.config.topicProvisioner(p.logger).topic(ctx, p.client, topic)
 }
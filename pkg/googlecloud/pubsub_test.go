@@ -4,14 +4,29 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
 
 	"cloud.google.com/go/pubsub"
 	"github.com/google/uuid"
+	"github.com/hashicorp/go-multierror"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 
 	"github.com/ThreeDotsLabs/watermill"
 	"github.com/ThreeDotsLabs/watermill/message"
@@ -106,6 +121,96 @@ func TestPublishSubscribe(t *testing.T) {
 	)
 }
 
+func createPubSubWithExactlyOnceDelivery(t *testing.T) (message.Publisher, message.Subscriber) {
+	return createPubSubWithSubscriptionNameWithExactlyOnceDelivery(t, "")
+}
+
+func createPubSubWithSubscriptionNameWithExactlyOnceDelivery(t *testing.T, subscriptionName string) (message.Publisher, message.Subscriber) {
+	logger := watermill.NewStdLogger(true, true)
+
+	publisher, err := googlecloud.NewPublisher(
+		googlecloud.PublisherConfig{
+			ProjectID: "tests",
+		},
+		logger,
+	)
+	require.NoError(t, err)
+
+	subscriber, err := googlecloud.NewSubscriber(
+		googlecloud.SubscriberConfig{
+			ProjectID:                "tests",
+			GenerateSubscriptionName: googlecloud.TopicSubscriptionNameWithSuffix(subscriptionName),
+			SubscriptionConfig: pubsub.SubscriptionConfig{
+				EnableExactlyOnceDelivery: true,
+			},
+		},
+		logger,
+	)
+	require.NoError(t, err)
+
+	return publisher, subscriber
+}
+
+func TestPublishSubscribeExactlyOnceDelivery(t *testing.T) {
+	tests.TestPubSub(
+		t,
+		tests.Features{
+			ConsumerGroups:      true,
+			ExactlyOnceDelivery: true,
+			GuaranteedOrder:     false,
+			Persistent:          true,
+		},
+		createPubSubWithExactlyOnceDelivery,
+		createPubSubWithSubscriptionNameWithExactlyOnceDelivery,
+	)
+}
+
+func createPubSubWithSynchronousPull(t *testing.T) (message.Publisher, message.Subscriber) {
+	return createPubSubWithSubscriptionNameWithSynchronousPull(t, "")
+}
+
+func createPubSubWithSubscriptionNameWithSynchronousPull(t *testing.T, subscriptionName string) (message.Publisher, message.Subscriber) {
+	logger := watermill.NewStdLogger(true, true)
+
+	publisher, err := googlecloud.NewPublisher(
+		googlecloud.PublisherConfig{
+			ProjectID: "tests",
+		},
+		logger,
+	)
+	require.NoError(t, err)
+
+	subscriber, err := googlecloud.NewSubscriber(
+		googlecloud.SubscriberConfig{
+			ProjectID:                "tests",
+			GenerateSubscriptionName: googlecloud.TopicSubscriptionNameWithSuffix(subscriptionName),
+			ReceiveMode:              googlecloud.ReceiveModeSynchronousPull,
+			SynchronousPullSettings: googlecloud.SynchronousPullSettings{
+				MaxMessages:  100,
+				WaitInterval: 100 * time.Millisecond,
+			},
+		},
+		logger,
+	)
+	require.NoError(t, err)
+
+	return publisher, subscriber
+}
+
+func TestPublishSubscribeSynchronousPull(t *testing.T) {
+	tests.TestPubSub(
+		t,
+		tests.Features{
+			ConsumerGroups:      true,
+			ExactlyOnceDelivery: false,
+			GuaranteedOrder:     false,
+			Persistent:          true,
+		},
+		createPubSubWithSynchronousPull,
+		createPubSubWithSubscriptionNameWithSynchronousPull,
+	)
+}
+
 func TestPublishSubscribeOrdering(t *testing.T) {
 	t.Skip("skipping because the emulator does not currently redeliver nacked messages when ordering is enabled")
 
@@ -401,3 +506,1677 @@ func TestPublishOrdering(t *testing.T) {
 	assert.Equal(t, []string{"1", "2"}, received["A"])
 	assert.Equal(t, []string{"3", "4"}, received["B"])
 }
+
+func TestPublishBatchSetsMessageIds(t *testing.T) {
+	topic := fmt.Sprintf("topic_publish_batch_%d", rand.Int())
+
+	pub, err := googlecloud.NewPublisher(googlecloud.PublisherConfig{
+		ProjectID: "tests",
+	}, nil)
+	require.NoError(t, err)
+	defer pub.Close()
+
+	messages := make([]*message.Message, 500)
+	for i := range messages {
+		messages[i] = message.NewMessage(watermill.NewUUID(), []byte(fmt.Sprintf("%d", i)))
+	}
+
+	require.NoError(t, pub.Publish(topic, messages...))
+
+	ids := map[string]struct{}{}
+	for _, msg := range messages {
+		id := msg.Metadata.Get(googlecloud.GoogleMessageIDHeaderKey)
+		require.NotEmpty(t, id, "message %s has no %s", msg.UUID, googlecloud.GoogleMessageIDHeaderKey)
+		ids[id] = struct{}{}
+	}
+	assert.Len(t, ids, len(messages))
+}
+
+func TestPublishBatchPartialFailure(t *testing.T) {
+	topic := fmt.Sprintf("topic_publish_batch_partial_failure_%d", rand.Int())
+
+	// Message ordering is not enabled, so the messages with an ordering key are rejected by the client library.
+	pub, err := googlecloud.NewPublisher(googlecloud.PublisherConfig{
+		ProjectID: "tests",
+		Marshaler: googlecloud.NewOrderingMarshaler(func(topic string, msg *message.Message) (string, error) {
+			return msg.Metadata.Get("ordering_key"), nil
+		}),
+	}, nil)
+	require.NoError(t, err)
+	defer pub.Close()
+
+	messages := make([]*message.Message, 4)
+	for i := range messages {
+		messages[i] = message.NewMessage(watermill.NewUUID(), []byte(fmt.Sprintf("%d", i)))
+	}
+	failed := []*message.Message{messages[1], messages[3]}
+	for _, msg := range failed {
+		msg.Metadata.Set("ordering_key", "key")
+	}
+
+	err = pub.Publish(topic, messages...)
+	require.Error(t, err)
+
+	var multiErr *multierror.Error
+	require.True(t, errors.As(err, &multiErr))
+	require.Len(t, multiErr.Errors, len(failed))
+	for i, msg := range failed {
+		assert.Contains(t, multiErr.Errors[i].Error(), msg.UUID)
+		assert.Empty(t, msg.Metadata.Get(googlecloud.GoogleMessageIDHeaderKey))
+	}
+
+	assert.NotEmpty(t, messages[0].Metadata.Get(googlecloud.GoogleMessageIDHeaderKey))
+	assert.NotEmpty(t, messages[2].Metadata.Get(googlecloud.GoogleMessageIDHeaderKey))
+}
+
+func TestPublishAsync(t *testing.T) {
+	topic := fmt.Sprintf("topic_publish_async_%d", rand.Int())
+
+	sub, err := googlecloud.NewSubscriber(googlecloud.SubscriberConfig{
+		ProjectID: "tests",
+	}, nil)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	pub, err := googlecloud.NewPublisher(googlecloud.PublisherConfig{
+		ProjectID: "tests",
+	}, nil)
+	require.NoError(t, err)
+
+	toPublish := make([]*message.Message, 10)
+	for i := range toPublish {
+		toPublish[i] = message.NewMessage(watermill.NewUUID(), []byte{})
+	}
+
+	results, err := pub.PublishAsync(ctx, topic, toPublish...)
+	require.NoError(t, err)
+	require.Len(t, results, len(toPublish))
+
+	publishedIDs := map[string]string{}
+	for i, result := range results {
+		require.Equal(t, toPublish[i], result.Message)
+
+		serverMessageID, err := result.Get(ctx)
+		require.NoError(t, err)
+		require.NotEmpty(t, serverMessageID)
+		assert.Equal(t, serverMessageID, result.Message.Metadata.Get(googlecloud.GoogleMessageIDHeaderKey))
+
+		publishedIDs[result.Message.UUID] = serverMessageID
+	}
+
+	for i := 0; i < len(toPublish); i++ {
+		select {
+		case msg := <-messages:
+			assert.Equal(t, publishedIDs[msg.UUID], msg.Metadata.Get(googlecloud.GoogleMessageIDHeaderKey))
+			msg.Ack()
+		case <-ctx.Done():
+			t.Fatal("timeout")
+		}
+	}
+
+	require.NoError(t, pub.Close())
+}
+
+func TestPublisherCloseWaitsForPublishAsync(t *testing.T) {
+	topic := fmt.Sprintf("topic_publish_async_close_%d", rand.Int())
+
+	pub, err := googlecloud.NewPublisher(googlecloud.PublisherConfig{
+		ProjectID: "tests",
+		PublishSettings: &pubsub.PublishSettings{
+			// Messages are not sent until the publisher is closed.
+			DelayThreshold: time.Hour,
+			CountThreshold: 1000,
+		},
+	}, nil)
+	require.NoError(t, err)
+
+	results, err := pub.PublishAsync(context.Background(), topic, message.NewMessage(watermill.NewUUID(), []byte{}))
+	require.NoError(t, err)
+
+	require.NoError(t, pub.Close())
+
+	select {
+	case <-results[0].Ready():
+	default:
+		t.Fatal("result should be ready after Close")
+	}
+
+	serverMessageID, err := results[0].Get(context.Background())
+	require.NoError(t, err)
+	assert.NotEmpty(t, serverMessageID)
+
+	_, err = pub.PublishAsync(context.Background(), topic, message.NewMessage(watermill.NewUUID(), []byte{}))
+	assert.Equal(t, googlecloud.ErrPublisherClosed, err)
+}
+
+type contextValueKey struct{}
+
+type contextMarshaler struct {
+	googlecloud.DefaultMarshalerUnmarshaler
+}
+
+func (m contextMarshaler) MarshalWithContext(ctx context.Context, topic string, msg *message.Message) (*pubsub.Message, error) {
+	pubsubMsg, err := m.Marshal(topic, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if value, ok := ctx.Value(contextValueKey{}).(string); ok {
+		pubsubMsg.Attributes["context_value"] = value
+	}
+
+	return pubsubMsg, nil
+}
+
+func TestPublishWithContext(t *testing.T) {
+	topic := fmt.Sprintf("topic_publish_with_context_%d", rand.Int())
+
+	sub, err := googlecloud.NewSubscriber(googlecloud.SubscriberConfig{
+		ProjectID: "tests",
+	}, nil)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	pub, err := googlecloud.NewPublisher(googlecloud.PublisherConfig{
+		ProjectID: "tests",
+		Marshaler: contextMarshaler{},
+	}, nil)
+	require.NoError(t, err)
+	defer pub.Close()
+
+	publishCtx := context.WithValue(ctx, contextValueKey{}, "from_context")
+	require.NoError(t, pub.PublishWithContext(publishCtx, topic, message.NewMessage(watermill.NewUUID(), []byte{})))
+
+	select {
+	case msg := <-messages:
+		assert.Equal(t, "from_context", msg.Metadata.Get("context_value"))
+		msg.Ack()
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+}
+
+func TestPublishWithContextCanceled(t *testing.T) {
+	topic := fmt.Sprintf("topic_publish_with_context_canceled_%d", rand.Int())
+
+	pub, err := googlecloud.NewPublisher(googlecloud.PublisherConfig{
+		ProjectID: "tests",
+	}, nil)
+	require.NoError(t, err)
+	defer pub.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = pub.PublishWithContext(ctx, topic, message.NewMessage(watermill.NewUUID(), []byte{}))
+	require.Error(t, err)
+}
+
+func TestPublisherTopicSettings(t *testing.T) {
+	orderedTopic := fmt.Sprintf("topic_settings_ordered_%d", rand.Int())
+	unorderedTopic := fmt.Sprintf("topic_settings_unordered_%d", rand.Int())
+
+	pub, err := googlecloud.NewPublisher(googlecloud.PublisherConfig{
+		ProjectID: "tests",
+		Marshaler: googlecloud.NewOrderingMarshaler(func(topic string, msg *message.Message) (string, error) {
+			return "ordering_key", nil
+		}),
+		TopicSettingsFn: func(topic string) googlecloud.TopicSettings {
+			if topic == orderedTopic {
+				return googlecloud.TopicSettings{
+					PublishSettings: &pubsub.PublishSettings{
+						DelayThreshold: time.Millisecond,
+						CountThreshold: 1,
+					},
+					EnableMessageOrdering: true,
+				}
+			}
+			return googlecloud.TopicSettings{}
+		},
+	}, nil)
+	require.NoError(t, err)
+	defer pub.Close()
+
+	require.NoError(t, pub.Publish(orderedTopic, message.NewMessage(watermill.NewUUID(), []byte{})))
+
+	// Publishing a message with an ordering key fails if the ordering is not enabled for the topic.
+	require.Error(t, pub.Publish(unorderedTopic, message.NewMessage(watermill.NewUUID(), []byte{})))
+}
+
+func TestTopicConfig(t *testing.T) {
+	publisherTopic := fmt.Sprintf("topic_config_publisher_%d", rand.Int())
+	subscriberTopic := fmt.Sprintf("topic_config_subscriber_%d", rand.Int())
+
+	topicConfigFn := func(topic string) pubsub.TopicConfig {
+		return pubsub.TopicConfig{
+			Labels: map[string]string{
+				"topic": topic,
+			},
+		}
+	}
+
+	pub, err := googlecloud.NewPublisher(googlecloud.PublisherConfig{
+		ProjectID:     "tests",
+		TopicConfigFn: topicConfigFn,
+	}, nil)
+	require.NoError(t, err)
+	defer pub.Close()
+
+	sub, err := googlecloud.NewSubscriber(googlecloud.SubscriberConfig{
+		ProjectID:     "tests",
+		TopicConfigFn: topicConfigFn,
+	}, nil)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	require.NoError(t, pub.Publish(publisherTopic, message.NewMessage(watermill.NewUUID(), []byte{})))
+	require.NoError(t, sub.SubscribeInitialize(subscriberTopic))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := pubsub.NewClient(ctx, "tests")
+	require.NoError(t, err)
+	defer client.Close()
+
+	for _, topic := range []string{publisherTopic, subscriberTopic} {
+		config, err := client.Topic(topic).Config(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"topic": topic}, config.Labels)
+	}
+}
+
+func TestSubscriberConfigDrift(t *testing.T) {
+	testNumber := rand.Int()
+	logger := watermill.NewStdLogger(true, true)
+
+	topic := fmt.Sprintf("topic_config_drift_%d", testNumber)
+	subscriptionName := fmt.Sprintf("sub_config_drift_%d", testNumber)
+	subNameFn := func(topic string) string {
+		return subscriptionName
+	}
+
+	newSubscriber := func(config pubsub.SubscriptionConfig, policies map[googlecloud.SubscriptionConfigField]googlecloud.SubscriptionConfigDriftPolicy) *googlecloud.Subscriber {
+		sub, err := googlecloud.NewSubscriber(googlecloud.SubscriberConfig{
+			ProjectID:                       "tests",
+			GenerateSubscriptionName:        subNameFn,
+			SubscriptionConfig:              config,
+			SubscriptionConfigDriftPolicies: policies,
+		}, logger)
+		require.NoError(t, err)
+		return sub
+	}
+
+	sub1 := newSubscriber(pubsub.SubscriptionConfig{
+		AckDeadline: 20 * time.Second,
+		Labels:      map[string]string{"version": "1"},
+	}, nil)
+	require.NoError(t, sub1.SubscribeInitialize(topic))
+
+	sub2 := newSubscriber(pubsub.SubscriptionConfig{
+		AckDeadline: 30 * time.Second,
+	}, map[googlecloud.SubscriptionConfigField]googlecloud.SubscriptionConfigDriftPolicy{
+		googlecloud.SubscriptionConfigFieldAckDeadline: googlecloud.SubscriptionConfigDriftFail,
+	})
+	err := sub2.SubscribeInitialize(topic)
+	require.Equal(t, googlecloud.ErrSubscriptionConfigDrift, errors.Cause(err))
+
+	sub3 := newSubscriber(pubsub.SubscriptionConfig{
+		AckDeadline: 30 * time.Second,
+		Labels:      map[string]string{"version": "2"},
+	}, map[googlecloud.SubscriptionConfigField]googlecloud.SubscriptionConfigDriftPolicy{
+		googlecloud.SubscriptionConfigFieldAckDeadline: googlecloud.SubscriptionConfigDriftUpdate,
+		googlecloud.SubscriptionConfigFieldLabels:      googlecloud.SubscriptionConfigDriftUpdate,
+	})
+	require.NoError(t, sub3.SubscribeInitialize(topic))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := pubsub.NewClient(ctx, "tests")
+	require.NoError(t, err)
+	defer client.Close()
+
+	config, err := client.Subscription(subscriptionName).Config(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 30*time.Second, config.AckDeadline)
+	assert.Equal(t, map[string]string{"version": "2"}, config.Labels)
+
+	sub4 := newSubscriber(pubsub.SubscriptionConfig{
+		Filter: `attributes.type = "test"`,
+	}, map[googlecloud.SubscriptionConfigField]googlecloud.SubscriptionConfigDriftPolicy{
+		googlecloud.SubscriptionConfigFieldFilter: googlecloud.SubscriptionConfigDriftUpdate,
+	})
+	require.Error(t, sub4.SubscribeInitialize(topic))
+}
+
+func TestSubscriberRecreateSubscriptionDryRun(t *testing.T) {
+	testNumber := rand.Int()
+	logger := watermill.NewStdLogger(true, true)
+
+	topic := fmt.Sprintf("topic_recreate_dry_run_%d", testNumber)
+	subscriptionName := fmt.Sprintf("sub_recreate_dry_run_%d", testNumber)
+	subNameFn := func(topic string) string {
+		return subscriptionName
+	}
+
+	sub1, err := googlecloud.NewSubscriber(googlecloud.SubscriberConfig{
+		ProjectID:                "tests",
+		GenerateSubscriptionName: subNameFn,
+	}, logger)
+	require.NoError(t, err)
+	require.NoError(t, sub1.SubscribeInitialize(topic))
+
+	sub2, err := googlecloud.NewSubscriber(googlecloud.SubscriberConfig{
+		ProjectID:                           "tests",
+		GenerateSubscriptionName:            subNameFn,
+		RecreateSubscriptionIfFilterChanged: true,
+		RecreateSubscriptionDryRun:          true,
+		SubscriptionConfig: pubsub.SubscriptionConfig{
+			Filter: `attributes.type = "test"`,
+		},
+	}, logger)
+	require.NoError(t, err)
+	require.NoError(t, sub2.SubscribeInitialize(topic))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := pubsub.NewClient(ctx, "tests")
+	require.NoError(t, err)
+	defer client.Close()
+
+	config, err := client.Subscription(subscriptionName).Config(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, config.Filter)
+}
+
+func TestSubscriberRecreateSubscriptionPreservesBacklog(t *testing.T) {
+	testNumber := rand.Int()
+	logger := watermill.NewStdLogger(true, true)
+
+	topic := fmt.Sprintf("topic_recreate_preserve_%d", testNumber)
+	subscriptionName := fmt.Sprintf("sub_recreate_preserve_%d", testNumber)
+	subNameFn := func(topic string) string {
+		return subscriptionName
+	}
+
+	sub1, err := googlecloud.NewSubscriber(googlecloud.SubscriberConfig{
+		ProjectID:                "tests",
+		GenerateSubscriptionName: subNameFn,
+	}, logger)
+	require.NoError(t, err)
+	require.NoError(t, sub1.SubscribeInitialize(topic))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	client, err := pubsub.NewClient(ctx, "tests")
+	require.NoError(t, err)
+	defer client.Close()
+
+	_, err = client.Subscription(subscriptionName).CreateSnapshot(ctx, fmt.Sprintf("snapshot_support_%d", testNumber))
+	if status.Code(err) == codes.Unimplemented {
+		t.Skip("snapshots are not supported by the emulator")
+	}
+	require.NoError(t, err)
+
+	howManyMessages := 10
+	published := map[string]struct{}{}
+
+	pub, err := googlecloud.NewPublisher(googlecloud.PublisherConfig{
+		ProjectID: "tests",
+	}, logger)
+	require.NoError(t, err)
+	defer pub.Close()
+
+	for i := 0; i < howManyMessages; i++ {
+		msg := message.NewMessage(watermill.NewUUID(), []byte{})
+		msg.Metadata.Set("type", "test")
+		require.NoError(t, pub.Publish(topic, msg))
+		published[msg.UUID] = struct{}{}
+	}
+
+	sub2, err := googlecloud.NewSubscriber(googlecloud.SubscriberConfig{
+		ProjectID:                           "tests",
+		GenerateSubscriptionName:            subNameFn,
+		RecreateSubscriptionIfFilterChanged: true,
+		RecreateSubscriptionMode:            googlecloud.SubscriptionRecreatePreserveBacklog,
+		SubscriptionConfig: pubsub.SubscriptionConfig{
+			Filter: `attributes.type = "test"`,
+		},
+	}, logger)
+	require.NoError(t, err)
+	defer sub2.Close()
+
+	messages, err := sub2.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	for len(published) > 0 {
+		select {
+		case msg := <-messages:
+			delete(published, msg.UUID)
+			msg.Ack()
+		case <-ctx.Done():
+			t.Fatalf("%d messages from the backlog were not received", len(published))
+		}
+	}
+
+	config, err := client.Subscription(subscriptionName).Config(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, `attributes.type = "test"`, config.Filter)
+}
+
+func TestSubscriberDeadLetterInvalidMaxDeliveryAttempts(t *testing.T) {
+	_, err := googlecloud.NewSubscriber(googlecloud.SubscriberConfig{
+		ProjectID: "tests",
+		DeadLetter: &googlecloud.DeadLetterConfig{
+			MaxDeliveryAttempts: 101,
+		},
+	}, nil)
+	require.Error(t, err)
+}
+
+func TestSubscriberDeadLetter(t *testing.T) {
+	testNumber := rand.Int()
+	logger := watermill.NewStdLogger(true, true)
+
+	topic := fmt.Sprintf("topic_dead_letter_%d", testNumber)
+	deadLetterTopic := topic + "-dead-letter"
+
+	sub, err := googlecloud.NewSubscriber(googlecloud.SubscriberConfig{
+		ProjectID: "tests",
+		DeadLetter: &googlecloud.DeadLetterConfig{
+			MaxDeliveryAttempts: 5,
+		},
+	}, logger)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	client, err := pubsub.NewClient(ctx, "tests")
+	require.NoError(t, err)
+	defer client.Close()
+
+	config, err := client.Subscription(topic).Config(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, config.DeadLetterPolicy)
+	assert.Equal(t, fmt.Sprintf("projects/tests/topics/%s", deadLetterTopic), config.DeadLetterPolicy.DeadLetterTopic)
+	assert.Equal(t, 5, config.DeadLetterPolicy.MaxDeliveryAttempts)
+
+	drainConfig, err := client.Subscription(deadLetterTopic).Config(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 7*24*time.Hour, drainConfig.RetentionDuration)
+
+	produceMessages(t, topic, 1)
+
+	select {
+	case msg := <-messages:
+		assert.Equal(t, "1", msg.Metadata.Get(googlecloud.DeliveryAttemptHeaderKey))
+		msg.Nack()
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+
+	select {
+	case msg := <-messages:
+		assert.Equal(t, "2", msg.Metadata.Get(googlecloud.DeliveryAttemptHeaderKey))
+		msg.Ack()
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+}
+
+func TestSubscriberNackDelay(t *testing.T) {
+	topic := fmt.Sprintf("topic_nack_delay_%d", rand.Int())
+	nackDelay := 2 * time.Second
+
+	sub, err := googlecloud.NewSubscriber(googlecloud.SubscriberConfig{
+		ProjectID: "tests",
+		NackDelay: googlecloud.FixedNackDelay(nackDelay),
+	}, nil)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	produceMessages(t, topic, 1)
+
+	var nackedAt time.Time
+	select {
+	case msg := <-messages:
+		nackedAt = time.Now()
+		msg.Nack()
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+
+	select {
+	case msg := <-messages:
+		assert.GreaterOrEqual(t, time.Since(nackedAt), nackDelay)
+		msg.Ack()
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+}
+
+func TestSubscriberNackDelaySynchronousPull(t *testing.T) {
+	topic := fmt.Sprintf("topic_nack_delay_sync_pull_%d", rand.Int())
+
+	sub, err := googlecloud.NewSubscriber(googlecloud.SubscriberConfig{
+		ProjectID:   "tests",
+		ReceiveMode: googlecloud.ReceiveModeSynchronousPull,
+		SynchronousPullSettings: googlecloud.SynchronousPullSettings{
+			MaxMessages:  1,
+			WaitInterval: 100 * time.Millisecond,
+		},
+		NackDelay: googlecloud.FixedNackDelay(time.Minute),
+	}, nil)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	produceMessages(t, topic, 1)
+
+	var nacked *message.Message
+	select {
+	case nacked = <-messages:
+		nacked.Nack()
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+
+	// The held message doesn't stop pulling other messages.
+	produceMessages(t, topic, 1)
+
+	select {
+	case msg := <-messages:
+		assert.NotEqual(t, nacked.UUID, msg.UUID)
+		msg.Ack()
+	case <-time.After(10 * time.Second):
+		t.Fatal("message not received while the nacked message is held")
+	}
+}
+
+func TestExponentialNackDelay(t *testing.T) {
+	delay := googlecloud.ExponentialNackDelay(time.Second, 10*time.Second)
+
+	assert.Equal(t, time.Second, delay(nil, 1))
+	assert.Equal(t, 2*time.Second, delay(nil, 2))
+	assert.Equal(t, 8*time.Second, delay(nil, 4))
+	assert.Equal(t, 10*time.Second, delay(nil, 5))
+	assert.Equal(t, 10*time.Second, delay(nil, 100))
+}
+
+func TestExtendAckDeadlineNotReceivedMessage(t *testing.T) {
+	msg := message.NewMessage(watermill.NewUUID(), []byte{})
+	assert.Equal(t, googlecloud.ErrAckDeadlineNotExtendable, googlecloud.ExtendAckDeadline(msg, time.Second))
+}
+
+func TestSubscriberExtendAckDeadline(t *testing.T) {
+	topic := fmt.Sprintf("topic_extend_ack_deadline_%d", rand.Int())
+
+	sub, err := googlecloud.NewSubscriber(googlecloud.SubscriberConfig{
+		ProjectID: "tests",
+		ReceiveSettings: pubsub.ReceiveSettings{
+			MaxExtension: 10 * time.Second,
+		},
+		DefaultAckExtension: time.Second,
+	}, nil)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	produceMessages(t, topic, 1)
+
+	var msg *message.Message
+	select {
+	case msg = <-messages:
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+
+	require.NoError(t, googlecloud.ExtendAckDeadline(msg, 3*time.Second))
+	assert.Equal(t, googlecloud.ErrMaxAckExtensionExceeded, googlecloud.ExtendAckDeadline(msg, time.Minute))
+
+	// The message is not acked, so it's nacked and redelivered once the extended deadline expires.
+	select {
+	case redelivered := <-messages:
+		assert.Equal(t, msg.UUID, redelivered.UUID)
+		redelivered.Ack()
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+
+	assert.Equal(t, googlecloud.ErrAckDeadlineExpired, googlecloud.ExtendAckDeadline(msg, time.Second))
+}
+
+func TestSubscriberExtendAckDeadlineDefaultConfig(t *testing.T) {
+	topic := fmt.Sprintf("topic_extend_ack_deadline_default_%d", rand.Int())
+
+	sub, err := googlecloud.NewSubscriber(googlecloud.SubscriberConfig{
+		ProjectID: "tests",
+	}, nil)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	produceMessages(t, topic, 1)
+
+	var msg *message.Message
+	select {
+	case msg = <-messages:
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+
+	// Without DefaultAckExtension, the ack deadline is already extended up to MaxExtension,
+	// so a shorter extension doesn't make the message nacked sooner.
+	require.NoError(t, googlecloud.ExtendAckDeadline(msg, 100*time.Millisecond))
+
+	select {
+	case redelivered := <-messages:
+		t.Fatalf("message %s redelivered", redelivered.UUID)
+	case <-time.After(2 * time.Second):
+	}
+
+	require.NoError(t, googlecloud.ExtendAckDeadline(msg, time.Second))
+	msg.Ack()
+}
+
+func TestSubscriberExtendAckDeadlineSynchronousPull(t *testing.T) {
+	topic := fmt.Sprintf("topic_extend_ack_deadline_sync_pull_%d", rand.Int())
+
+	sub, err := googlecloud.NewSubscriber(googlecloud.SubscriberConfig{
+		ProjectID:   "tests",
+		ReceiveMode: googlecloud.ReceiveModeSynchronousPull,
+		ReceiveSettings: pubsub.ReceiveSettings{
+			MaxExtension: 2 * time.Second,
+		},
+		SynchronousPullSettings: googlecloud.SynchronousPullSettings{
+			AckDeadline: 10 * time.Second,
+		},
+	}, nil)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	produceMessages(t, topic, 1)
+
+	var msg *message.Message
+	select {
+	case msg = <-messages:
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+
+	// The ack deadline is extended in Pub/Sub, so it's not limited by MaxExtension.
+	require.NoError(t, googlecloud.ExtendAckDeadline(msg, 30*time.Second))
+
+	// The message is not redelivered while its deadline is extended beyond MaxExtension and the initial AckDeadline.
+	select {
+	case redelivered := <-messages:
+		t.Fatalf("message %s redelivered", redelivered.UUID)
+	case <-time.After(15 * time.Second):
+	}
+
+	msg.Ack()
+}
+
+func TestSubscribeDrain(t *testing.T) {
+	testCases := []struct {
+		name              string
+		config            googlecloud.DrainConfig
+		expectedProcessed int
+	}{
+		{
+			name:              "idle_timeout",
+			config:            googlecloud.DrainConfig{IdleTimeout: 2 * time.Second},
+			expectedProcessed: 10,
+		},
+		{
+			name:              "max_messages",
+			config:            googlecloud.DrainConfig{IdleTimeout: time.Minute, MaxMessages: 4},
+			expectedProcessed: 4,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			topic := fmt.Sprintf("topic_drain_%s_%d", tc.name, rand.Int())
+
+			sub, err := googlecloud.NewSubscriber(googlecloud.SubscriberConfig{
+				ProjectID: "tests",
+			}, nil)
+			require.NoError(t, err)
+			defer sub.Close()
+
+			require.NoError(t, sub.SubscribeInitialize(topic))
+			produceMessages(t, topic, 10)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			messages, result, err := sub.SubscribeDrain(ctx, topic, tc.config)
+			require.NoError(t, err)
+
+			received := 0
+			for msg := range messages {
+				// The first message is nacked, so it's redelivered.
+				if received == 0 {
+					msg.Nack()
+				} else {
+					msg.Ack()
+				}
+				received++
+			}
+
+			summary, err := result.Get(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, received, summary.Processed)
+			assert.Equal(t, 1, summary.Nacked)
+			assert.Equal(t, summary.Processed-1, summary.Acked)
+			if tc.config.MaxMessages != 0 {
+				assert.Equal(t, tc.expectedProcessed, summary.Processed)
+			} else {
+				// The nacked message is processed twice.
+				assert.Equal(t, tc.expectedProcessed+1, summary.Processed)
+			}
+		})
+	}
+}
+
+func receiveMessages(t *testing.T, ctx context.Context, messages <-chan *message.Message, howMany int) map[string]struct{} {
+	received := map[string]struct{}{}
+	for len(received) < howMany {
+		select {
+		case msg := <-messages:
+			received[msg.UUID] = struct{}{}
+			msg.Ack()
+		case <-ctx.Done():
+			t.Fatalf("received %d of %d messages", len(received), howMany)
+		}
+	}
+	return received
+}
+
+func TestSubscriberSeekToTime(t *testing.T) {
+	topic := fmt.Sprintf("topic_seek_to_time_%d", rand.Int())
+	logger := watermill.NewStdLogger(true, true)
+
+	newSubscriber := func(startFrom googlecloud.StartFrom) *googlecloud.Subscriber {
+		sub, err := googlecloud.NewSubscriber(googlecloud.SubscriberConfig{
+			ProjectID: "tests",
+			SubscriptionConfig: pubsub.SubscriptionConfig{
+				RetainAckedMessages: true,
+			},
+			StartFrom: startFrom,
+		}, logger)
+		require.NoError(t, err)
+		return sub
+	}
+
+	sub1 := newSubscriber(googlecloud.StartFrom{})
+	defer sub1.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	require.NoError(t, sub1.SubscribeInitialize(topic))
+
+	beforePublish := time.Now().Add(-time.Second)
+	howManyMessages := 5
+	produceMessages(t, topic, howManyMessages)
+
+	err := sub1.SeekToTime(ctx, topic, beforePublish)
+	if status.Code(errors.Cause(err)) == codes.Unimplemented {
+		t.Skip("seeking is not supported by the emulator")
+	}
+	require.NoError(t, err)
+
+	messages, err := sub1.Subscribe(ctx, topic)
+	require.NoError(t, err)
+	received := receiveMessages(t, ctx, messages, howManyMessages)
+	require.NoError(t, sub1.Close())
+
+	// The messages were acked, but a new subscriber rewinds the subscription on startup.
+	sub2 := newSubscriber(googlecloud.StartFrom{Time: beforePublish})
+	defer sub2.Close()
+
+	messages, err = sub2.Subscribe(ctx, topic)
+	require.NoError(t, err)
+	assert.Equal(t, received, receiveMessages(t, ctx, messages, howManyMessages))
+
+	// StartFrom is applied only once, so subscribing again doesn't replay the messages.
+	require.NoError(t, sub2.Unsubscribe(topic))
+	messages, err = sub2.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	select {
+	case msg := <-messages:
+		t.Fatalf("message %s replayed", msg.UUID)
+	case <-time.After(2 * time.Second):
+	}
+}
+
+func TestSubscriberSnapshots(t *testing.T) {
+	testNumber := rand.Int()
+	topic := fmt.Sprintf("topic_snapshots_%d", testNumber)
+	snapshotName := fmt.Sprintf("snapshot_%d", testNumber)
+
+	sub, err := googlecloud.NewSubscriber(googlecloud.SubscriberConfig{
+		ProjectID: "tests",
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	require.NoError(t, sub.SubscribeInitialize(topic))
+
+	howManyMessages := 5
+	produceMessages(t, topic, howManyMessages)
+
+	_, err = sub.CreateSnapshot(ctx, topic, snapshotName)
+	if status.Code(errors.Cause(err)) == codes.Unimplemented {
+		t.Skip("snapshots are not supported by the emulator")
+	}
+	require.NoError(t, err)
+
+	snapshots, err := sub.ListSnapshots(ctx, topic)
+	require.NoError(t, err)
+	require.Len(t, snapshots, 1)
+	assert.Equal(t, snapshotName, snapshots[0].ID())
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+	received := receiveMessages(t, ctx, messages, howManyMessages)
+
+	// The messages were acked after the snapshot was created, so they are redelivered.
+	require.NoError(t, sub.SeekToSnapshot(ctx, topic, snapshotName))
+	assert.Equal(t, received, receiveMessages(t, ctx, messages, howManyMessages))
+
+	require.NoError(t, sub.DeleteSnapshot(ctx, snapshotName))
+
+	snapshots, err = sub.ListSnapshots(ctx, topic)
+	require.NoError(t, err)
+	assert.Empty(t, snapshots)
+}
+
+func TestSubscriberUnsubscribe(t *testing.T) {
+	testCases := []struct {
+		name        string
+		unsubscribe func(sub *googlecloud.Subscriber, topic string, cancel context.CancelFunc) error
+	}{
+		{
+			name: "unsubscribe",
+			unsubscribe: func(sub *googlecloud.Subscriber, topic string, cancel context.CancelFunc) error {
+				return sub.Unsubscribe(topic)
+			},
+		},
+		{
+			name: "context_canceled",
+			unsubscribe: func(sub *googlecloud.Subscriber, topic string, cancel context.CancelFunc) error {
+				cancel()
+				return nil
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			topic := fmt.Sprintf("topic_unsubscribe_%s_%d", tc.name, rand.Int())
+			otherTopic := fmt.Sprintf("topic_unsubscribe_%s_other_%d", tc.name, rand.Int())
+
+			sub, err := googlecloud.NewSubscriber(googlecloud.SubscriberConfig{
+				ProjectID: "tests",
+			}, watermill.NewStdLogger(true, true))
+			require.NoError(t, err)
+			defer sub.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			subscribeCtx, cancelSubscribe := context.WithCancel(ctx)
+			defer cancelSubscribe()
+
+			messages, err := sub.Subscribe(subscribeCtx, topic)
+			require.NoError(t, err)
+			otherMessages, err := sub.Subscribe(ctx, otherTopic)
+			require.NoError(t, err)
+
+			produceMessages(t, topic, 2)
+			receiveMessages(t, ctx, messages, 2)
+
+			require.NoError(t, tc.unsubscribe(sub, topic, cancelSubscribe))
+
+			select {
+			case _, ok := <-messages:
+				assert.False(t, ok, "output channel should be closed")
+			case <-ctx.Done():
+				t.Fatal("output channel was not closed")
+			}
+
+			// Other subscriptions are not affected.
+			produceMessages(t, otherTopic, 2)
+			receiveMessages(t, ctx, otherMessages, 2)
+
+			// A later Subscribe starts fresh.
+			messages, err = sub.Subscribe(ctx, topic)
+			require.NoError(t, err)
+			produceMessages(t, topic, 2)
+			receiveMessages(t, ctx, messages, 2)
+		})
+	}
+}
+
+func TestSubscriberConcurrentSubscribe(t *testing.T) {
+	testCases := []struct {
+		name        string
+		receiveMode googlecloud.ReceiveMode
+	}{
+		{name: "streaming_pull", receiveMode: googlecloud.ReceiveModeStreamingPull},
+		{name: "synchronous_pull", receiveMode: googlecloud.ReceiveModeSynchronousPull},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			topic := fmt.Sprintf("topic_concurrent_subscribe_%s_%d", tc.name, rand.Int())
+
+			sub, err := googlecloud.NewSubscriber(googlecloud.SubscriberConfig{
+				ProjectID:   "tests",
+				ReceiveMode: tc.receiveMode,
+			}, watermill.NewStdLogger(true, true))
+			require.NoError(t, err)
+			defer sub.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			require.NoError(t, sub.SubscribeInitialize(topic))
+
+			howManySubscribers := 3
+			outputs := make([]<-chan *message.Message, howManySubscribers)
+			wg := sync.WaitGroup{}
+			for i := range outputs {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					messages, err := sub.Subscribe(ctx, topic)
+					assert.NoError(t, err)
+					outputs[i] = messages
+				}(i)
+			}
+			wg.Wait()
+			require.False(t, t.Failed())
+
+			howManyMessages := 30
+			produceMessages(t, topic, howManyMessages)
+
+			receivedLock := sync.Mutex{}
+			received := map[string]struct{}{}
+			for _, messages := range outputs {
+				go func(messages <-chan *message.Message) {
+					for msg := range messages {
+						receivedLock.Lock()
+						received[msg.UUID] = struct{}{}
+						receivedLock.Unlock()
+						msg.Ack()
+					}
+				}(messages)
+			}
+
+			assert.Eventually(t, func() bool {
+				receivedLock.Lock()
+				defer receivedLock.Unlock()
+				return len(received) == howManyMessages
+			}, 20*time.Second, 100*time.Millisecond)
+
+			// The messages were acked, so they are not redelivered.
+			require.NoError(t, sub.Unsubscribe(topic))
+			messages, err := sub.Subscribe(ctx, topic)
+			require.NoError(t, err)
+			select {
+			case msg := <-messages:
+				t.Fatalf("unexpected redelivery of message %s", msg.UUID)
+			case <-time.After(2 * time.Second):
+			}
+		})
+	}
+}
+
+func TestClientPool(t *testing.T) {
+	topic := fmt.Sprintf("topic_client_pool_%d", rand.Int())
+	logger := watermill.NewStdLogger(true, true)
+
+	pool := googlecloud.NewClientPool()
+	defer pool.Close()
+
+	pub, err := googlecloud.NewPublisher(googlecloud.PublisherConfig{
+		ProjectID:  "tests",
+		ClientPool: pool,
+	}, logger)
+	require.NoError(t, err)
+
+	sub, err := googlecloud.NewSubscriber(googlecloud.SubscriberConfig{
+		ProjectID:  "tests",
+		ClientPool: pool,
+	}, logger)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	require.NoError(t, pub.Publish(topic, message.NewMessage(watermill.NewUUID(), []byte("payload"))))
+	receiveMessages(t, ctx, messages, 1)
+
+	// Synchronous pull uses the low-level subscriber client of the pool.
+	pullSub, err := googlecloud.NewSubscriber(googlecloud.SubscriberConfig{
+		ProjectID:                "tests",
+		GenerateSubscriptionName: googlecloud.TopicSubscriptionNameWithSuffix("pull"),
+		ClientPool:               pool,
+		ReceiveMode:              googlecloud.ReceiveModeSynchronousPull,
+	}, logger)
+	require.NoError(t, err)
+
+	pulledMessages, err := pullSub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	require.NoError(t, pub.Publish(topic, message.NewMessage(watermill.NewUUID(), []byte("payload"))))
+	receiveMessages(t, ctx, pulledMessages, 1)
+
+	require.NoError(t, pub.Close())
+	require.NoError(t, sub.Close())
+	require.NoError(t, pullSub.Close())
+
+	// The shared client is still open after the Publisher and Subscriber are closed.
+	client, err := pool.Client(ctx, "tests")
+	require.NoError(t, err)
+	exists, err := client.Topic(topic).Exists(ctx)
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	// A Subscriber using the client directly doesn't close it either.
+	sub, err = googlecloud.NewSubscriber(googlecloud.SubscriberConfig{
+		Client: client,
+	}, logger)
+	require.NoError(t, err)
+	messages, err = sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+	require.NoError(t, sub.Close())
+	_, ok := <-messages
+	assert.False(t, ok)
+
+	_, err = client.Topic(topic).Exists(ctx)
+	require.NoError(t, err)
+
+	require.NoError(t, pool.Close())
+	_, err = pool.Client(ctx, "tests")
+	assert.ErrorIs(t, err, googlecloud.ErrClientPoolClosed)
+}
+
+func TestClientPoolInvalidConfig(t *testing.T) {
+	pool := googlecloud.NewClientPool()
+	defer pool.Close()
+
+	client := &pubsub.Client{}
+
+	_, err := googlecloud.NewSubscriber(googlecloud.SubscriberConfig{
+		ProjectID:  "tests",
+		Client:     client,
+		ClientPool: pool,
+	}, nil)
+	assert.Error(t, err)
+
+	_, err = googlecloud.NewPublisher(googlecloud.PublisherConfig{
+		ProjectID:  "tests",
+		Client:     client,
+		ClientPool: pool,
+	}, nil)
+	assert.Error(t, err)
+
+	// The options of the client used by synchronous pull can't be read from Client.
+	_, err = googlecloud.NewSubscriber(googlecloud.SubscriberConfig{
+		Client:      client,
+		ReceiveMode: googlecloud.ReceiveModeSynchronousPull,
+	}, nil)
+	assert.Error(t, err)
+
+	_, err = googlecloud.NewSubscriber(googlecloud.SubscriberConfig{
+		Client:      client,
+		ReceiveMode: googlecloud.ReceiveModeSynchronousPull,
+		SynchronousPullSettings: googlecloud.SynchronousPullSettings{
+			ClientOptions: []option.ClientOption{option.WithoutAuthentication()},
+		},
+	}, nil)
+	assert.NoError(t, err)
+}
+
+func TestIsPermanentReceiveError(t *testing.T) {
+	testCases := []struct {
+		name      string
+		err       error
+		permanent bool
+	}{
+		{name: "not_found", err: status.Error(codes.NotFound, "subscription not found"), permanent: true},
+		{name: "permission_denied", err: status.Error(codes.PermissionDenied, "permission denied"), permanent: true},
+		{name: "failed_precondition", err: status.Error(codes.FailedPrecondition, "subscription detached"), permanent: true},
+		{name: "wrapped", err: errors.Wrap(status.Error(codes.NotFound, "subscription not found"), "pull failed"), permanent: true},
+		{name: "unavailable", err: status.Error(codes.Unavailable, "unavailable"), permanent: false},
+		{name: "not_grpc", err: errors.New("connection reset"), permanent: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.permanent, googlecloud.IsPermanentReceiveError(tc.err))
+		})
+	}
+}
+
+func TestSubscriberPermanentReceiveError(t *testing.T) {
+	topic := fmt.Sprintf("topic_permanent_receive_error_%d", rand.Int())
+
+	receiveErrors := make(chan error, 1)
+	sub, err := googlecloud.NewSubscriber(googlecloud.SubscriberConfig{
+		ProjectID: "tests",
+		OnReceiveError: func(errorTopic string, err error) {
+			assert.Equal(t, topic, errorTopic)
+			receiveErrors <- err
+		},
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	client, err := pubsub.NewClient(ctx, "tests")
+	require.NoError(t, err)
+	defer client.Close()
+	require.NoError(t, client.Subscription(topic).Delete(ctx))
+
+	select {
+	case err := <-receiveErrors:
+		assert.Equal(t, codes.NotFound, status.Code(errors.Cause(err)))
+	case <-ctx.Done():
+		t.Fatal("permanent receive error was not reported")
+	}
+
+	select {
+	case _, ok := <-messages:
+		assert.False(t, ok, "output channel should be closed")
+	case <-ctx.Done():
+		t.Fatal("output channel was not closed")
+	}
+}
+
+func TestSubscriberRecreateDeletedSubscription(t *testing.T) {
+	topic := fmt.Sprintf("topic_recreate_deleted_subscription_%d", rand.Int())
+
+	sub, err := googlecloud.NewSubscriber(googlecloud.SubscriberConfig{
+		ProjectID:                   "tests",
+		RecreateDeletedSubscription: true,
+		OnReceiveError: func(topic string, err error) {
+			t.Errorf("unexpected receive error: %s", err)
+		},
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	produceMessages(t, topic, 1)
+	receiveMessages(t, ctx, messages, 1)
+
+	client, err := pubsub.NewClient(ctx, "tests")
+	require.NoError(t, err)
+	defer client.Close()
+	require.NoError(t, client.Subscription(topic).Delete(ctx))
+
+	// Only messages published after the subscription is recreated are received, so keep publishing until one is.
+	for {
+		produceMessages(t, topic, 1)
+
+		select {
+		case msg, ok := <-messages:
+			require.True(t, ok, "output channel should not be closed")
+			msg.Ack()
+
+			exists, err := client.Subscription(topic).Exists(ctx)
+			require.NoError(t, err)
+			assert.True(t, exists)
+			return
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			t.Fatal("subscription was not recreated")
+		}
+	}
+}
+
+func TestSubscriberCloseWithContext(t *testing.T) {
+	topic := fmt.Sprintf("topic_close_with_context_%d", rand.Int())
+
+	sub, err := googlecloud.NewSubscriber(googlecloud.SubscriberConfig{
+		ProjectID: "tests",
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	produceMessages(t, topic, 2)
+
+	var received []*message.Message
+	for len(received) < 2 {
+		select {
+		case msg := <-messages:
+			received = append(received, msg)
+		case <-ctx.Done():
+			t.Fatal("timeout")
+		}
+	}
+
+	// The third message is received, but not delivered, so it's not counted in the summary.
+	produceMessages(t, topic, 1)
+
+	// The first message finishes while draining, the second one is never acked.
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		received[0].Ack()
+	}()
+
+	closeCtx, cancelClose := context.WithTimeout(ctx, 3*time.Second)
+	defer cancelClose()
+
+	summary, err := sub.CloseWithContext(closeCtx)
+	require.NoError(t, err)
+	assert.Equal(t, googlecloud.CloseSummary{Drained: 1, Nacked: 1}, summary)
+
+	select {
+	case <-received[0].Acked():
+	default:
+		t.Error("message should be acked")
+	}
+
+	_, ok := <-messages
+	assert.False(t, ok, "output channel should be closed")
+}
+
+func TestPublisherConcurrentClose(t *testing.T) {
+	ctx := context.Background()
+
+	// Nothing listens on the endpoint, so the messages are not published, but the results still resolve.
+	client, err := pubsub.NewClient(
+		ctx,
+		"tests",
+		option.WithEndpoint("localhost:1"),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+	)
+	require.NoError(t, err)
+	defer client.Close()
+
+	pub, err := googlecloud.NewPublisher(googlecloud.PublisherConfig{
+		Client:                   client,
+		DoNotCheckTopicExistence: true,
+		PublishSettings: &pubsub.PublishSettings{
+			Timeout: 100 * time.Millisecond,
+		},
+		PublishTimeout: time.Second,
+	}, nil)
+	require.NoError(t, err)
+
+	resultsLock := sync.Mutex{}
+	var results []*googlecloud.PublishResult
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				msg := message.NewMessage(watermill.NewUUID(), []byte("payload"))
+
+				var err error
+				if i%2 == 0 {
+					err = pub.Publish("topic", msg)
+				} else {
+					var published []*googlecloud.PublishResult
+					published, err = pub.PublishAsync(ctx, "topic", msg)
+					resultsLock.Lock()
+					results = append(results, published...)
+					resultsLock.Unlock()
+				}
+				if errors.Is(err, googlecloud.ErrPublisherClosed) {
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}(i)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	closeErrs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			closeErrs <- pub.Close()
+		}()
+	}
+	closeErr := <-closeErrs
+	assert.Equal(t, closeErr, <-closeErrs)
+	assert.Equal(t, closeErr, pub.Close())
+
+	wg.Wait()
+
+	resultsLock.Lock()
+	defer resultsLock.Unlock()
+	for _, result := range results {
+		select {
+		case <-result.Ready():
+		default:
+			t.Fatal("Close should wait for all results")
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	topic := fmt.Sprintf("topic_tracing_%d", rand.Int())
+	logger := watermill.NewStdLogger(true, true)
+
+	exporter := tracetest.NewInMemoryExporter()
+	tracerProvider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	tracing := &googlecloud.TracingConfig{TracerProvider: tracerProvider}
+
+	pub, err := googlecloud.NewPublisher(googlecloud.PublisherConfig{
+		ProjectID: "tests",
+		Tracing:   tracing,
+	}, logger)
+	require.NoError(t, err)
+	defer pub.Close()
+
+	sub, err := googlecloud.NewSubscriber(googlecloud.SubscriberConfig{
+		ProjectID: "tests",
+		Tracing:   tracing,
+	}, logger)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	require.NoError(t, sub.SubscribeInitialize(topic))
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	publishCtx, parentSpan := tracerProvider.Tracer("test").Start(ctx, "parent")
+	require.NoError(t, pub.PublishWithContext(publishCtx, topic, message.NewMessage(watermill.NewUUID(), []byte("payload"))))
+	parentSpan.End()
+
+	select {
+	case msg := <-messages:
+		assert.NotEmpty(t, msg.Metadata.Get("traceparent"))
+
+		processSpan := trace.SpanContextFromContext(msg.Context())
+		require.True(t, processSpan.IsValid())
+		assert.Equal(t, parentSpan.SpanContext().TraceID(), processSpan.TraceID())
+
+		msg.Ack()
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+
+	require.Eventually(t, func() bool {
+		return len(exporter.GetSpans()) == 4
+	}, 10*time.Second, 100*time.Millisecond)
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		assert.Equal(t, parentSpan.SpanContext().TraceID(), span.SpanContext.TraceID(), span.Name)
+		spans[span.Name] = span
+	}
+
+	publishSpan := spans[topic+" publish"]
+	assert.Equal(t, trace.SpanKindProducer, publishSpan.SpanKind)
+	assert.Equal(t, parentSpan.SpanContext().SpanID(), publishSpan.Parent.SpanID())
+
+	receiveSpan := spans[topic+" receive"]
+	assert.Equal(t, trace.SpanKindConsumer, receiveSpan.SpanKind)
+	assert.Equal(t, publishSpan.SpanContext.SpanID(), receiveSpan.Parent.SpanID())
+
+	processSpan := spans[topic+" process"]
+	assert.Equal(t, receiveSpan.SpanContext.SpanID(), processSpan.Parent.SpanID())
+
+	attributes := map[attribute.Key]attribute.Value{}
+	for _, kv := range processSpan.Attributes {
+		attributes[kv.Key] = kv.Value
+	}
+	assert.Equal(t, topic, attributes["messaging.destination.name"].AsString())
+	assert.Equal(t, topic, attributes["messaging.destination.subscription.name"].AsString())
+	assert.NotEmpty(t, attributes["messaging.message.id"].AsString())
+}
+
+func TestMetrics(t *testing.T) {
+	topic := fmt.Sprintf("topic_metrics_%d", rand.Int())
+	logger := watermill.NewStdLogger(true, true)
+
+	reader := sdkmetric.NewManualReader()
+	metrics, err := googlecloud.NewOpenTelemetryMetrics(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+	require.NoError(t, err)
+
+	pub, err := googlecloud.NewPublisher(googlecloud.PublisherConfig{
+		ProjectID: "tests",
+		Metrics:   metrics,
+	}, logger)
+	require.NoError(t, err)
+	defer pub.Close()
+
+	sub, err := googlecloud.NewSubscriber(googlecloud.SubscriberConfig{
+		ProjectID: "tests",
+		Metrics:   metrics,
+	}, logger)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	require.NoError(t, sub.SubscribeInitialize(topic))
+	messages, err := sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	require.NoError(t, pub.Publish(topic, message.NewMessage(watermill.NewUUID(), []byte("payload"))))
+	receiveMessages(t, ctx, messages, 1)
+
+	require.NoError(t, pub.Publish(topic, message.NewMessage(watermill.NewUUID(), []byte("payload"))))
+	select {
+	case msg := <-messages:
+		msg.Nack()
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+	// the nacked message is redelivered
+	receiveMessages(t, ctx, messages, 1)
+
+	sums := map[string]int64{}
+	histogramCounts := map[string]uint64{}
+
+	require.Eventually(t, func() bool {
+		var collected metricdata.ResourceMetrics
+		require.NoError(t, reader.Collect(ctx, &collected))
+
+		for _, scopeMetrics := range collected.ScopeMetrics {
+			for _, m := range scopeMetrics.Metrics {
+				switch data := m.Data.(type) {
+				case metricdata.Sum[int64]:
+					sums[m.Name] = 0
+					for _, point := range data.DataPoints {
+						topicAttribute, _ := point.Attributes.Value("messaging.destination.name")
+						assert.Equal(t, topic, topicAttribute.AsString(), m.Name)
+						sums[m.Name] += point.Value
+					}
+				case metricdata.Histogram[float64]:
+					histogramCounts[m.Name] = 0
+					for _, point := range data.DataPoints {
+						histogramCounts[m.Name] += point.Count
+					}
+				}
+			}
+		}
+
+		return sums["watermill.googlecloud.messages.acked"] == 2 && sums["watermill.googlecloud.messages.nacked"] == 1
+	}, 10*time.Second, 100*time.Millisecond)
+
+	assert.EqualValues(t, 2, histogramCounts["watermill.googlecloud.publish.duration"])
+	assert.Zero(t, sums["watermill.googlecloud.publish.failures"])
+	assert.EqualValues(t, 3, sums["watermill.googlecloud.messages.received"])
+	assert.EqualValues(t, 3, histogramCounts["watermill.googlecloud.message.latency"])
+	assert.EqualValues(t, 3, histogramCounts["watermill.googlecloud.message.ack_duration"])
+}
+
+func TestSubscriberHealth(t *testing.T) {
+	topic := fmt.Sprintf("topic_subscriber_health_%d", rand.Int())
+
+	sub, err := googlecloud.NewSubscriber(googlecloud.SubscriberConfig{
+		ProjectID: "tests",
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err = sub.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	health := sub.Health()
+	require.Len(t, health.Subscriptions, 1)
+	assert.Equal(t, topic, health.Subscriptions[0].Topic)
+	assert.Equal(t, googlecloud.SubscriptionReceiving, health.Subscriptions[0].State)
+	assert.NoError(t, sub.Live())
+	assert.NoError(t, sub.Ready())
+
+	client, err := pubsub.NewClient(ctx, "tests")
+	require.NoError(t, err)
+	defer client.Close()
+	require.NoError(t, client.Subscription(topic).Delete(ctx))
+
+	require.Eventually(t, func() bool {
+		return sub.Health().Subscriptions[0].State == googlecloud.SubscriptionStopped
+	}, 10*time.Second, 100*time.Millisecond)
+
+	health = sub.Health()
+	assert.Equal(t, codes.NotFound, status.Code(errors.Cause(health.Subscriptions[0].LastError)))
+	assert.Error(t, sub.Live())
+	assert.Error(t, sub.Ready())
+
+	require.NoError(t, sub.Close())
+	assert.True(t, sub.Health().Closed)
+	assert.ErrorIs(t, sub.Ready(), googlecloud.ErrSubscriberClosed)
+}
+
+func TestPublisherHealth(t *testing.T) {
+	// Nothing listens on the endpoint, so publishing fails.
+	client, err := pubsub.NewClient(
+		context.Background(),
+		"tests",
+		option.WithEndpoint("localhost:1"),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+	)
+	require.NoError(t, err)
+	defer client.Close()
+
+	pub, err := googlecloud.NewPublisher(googlecloud.PublisherConfig{
+		Client:                   client,
+		DoNotCheckTopicExistence: true,
+		PublishSettings: &pubsub.PublishSettings{
+			Timeout: 100 * time.Millisecond,
+		},
+		PublishTimeout:    time.Second,
+		HealthErrorWindow: time.Second,
+	}, nil)
+	require.NoError(t, err)
+
+	serve := func(handler http.Handler) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+		return recorder
+	}
+
+	assert.Empty(t, pub.Health().Topics)
+	assert.Equal(t, http.StatusOK, serve(googlecloud.NewReadinessHandler(pub)).Code)
+
+	require.Error(t, pub.Publish("topic", message.NewMessage(watermill.NewUUID(), []byte("payload"))))
+
+	health := pub.Health()
+	require.Contains(t, health.Topics, "topic")
+	assert.Error(t, health.Topics["topic"].LastError)
+	assert.True(t, health.Topics["topic"].Failing)
+
+	assert.Equal(t, http.StatusOK, serve(googlecloud.NewLivenessHandler(pub)).Code)
+	notReady := serve(googlecloud.NewReadinessHandler(pub))
+	assert.Equal(t, http.StatusServiceUnavailable, notReady.Code)
+	assert.Contains(t, notReady.Body.String(), "publishing to topic topic failed")
+
+	// The failed publish stops affecting readiness once it's older than HealthErrorWindow.
+	assert.Eventually(t, func() bool {
+		return pub.Ready() == nil
+	}, 5*time.Second, 100*time.Millisecond)
+	assert.False(t, pub.Health().Topics["topic"].Failing)
+
+	require.NoError(t, pub.Close())
+	assert.True(t, pub.Health().Closed)
+	assert.ErrorIs(t, pub.Ready(), googlecloud.ErrPublisherClosed)
+}
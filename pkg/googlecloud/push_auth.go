@@ -0,0 +1,389 @@
+package googlecloud
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrInvalidPushToken happens when the bearer token of a push request can't be verified.
+var ErrInvalidPushToken = errors.New("invalid push token")
+
+// GoogleOIDCCertsURL is the URL of the JSON Web Key Set used by Google to sign OIDC tokens.
+const GoogleOIDCCertsURL = "https://www.googleapis.com/oauth2/v3/certs"
+
+// oidcClockSkew is the tolerated difference between the clocks of Google and the PushSubscriber.
+const oidcClockSkew = time.Minute
+
+// PushTokenVerifier verifies the bearer token that Pub/Sub sends with a push request.
+type PushTokenVerifier interface {
+	VerifyPushToken(ctx context.Context, token string) error
+}
+
+// OIDCKeySet provides the public keys used to verify the signature of OIDC tokens.
+type OIDCKeySet interface {
+	PublicKey(ctx context.Context, keyID string) (*rsa.PublicKey, error)
+}
+
+// StaticOIDCKeySet is a fixed set of public keys by key ID.
+// It's useful for verifying tokens signed by a local key in tests.
+type StaticOIDCKeySet map[string]*rsa.PublicKey
+
+func (k StaticOIDCKeySet) PublicKey(ctx context.Context, keyID string) (*rsa.PublicKey, error) {
+	key, ok := k[keyID]
+	if !ok {
+		return nil, errors.Errorf("unknown key ID %s", keyID)
+	}
+
+	return key, nil
+}
+
+// RemoteOIDCKeySet fetches the public keys from a JSON Web Key Set URL.
+// The keys are cached for CacheTTL, and fetched again if a token is signed by an unknown key,
+// but not more often than every MinRefetchInterval, so tokens with made up key IDs can't flood the URL.
+type RemoteOIDCKeySet struct {
+	// URL of the JSON Web Key Set. By default, GoogleOIDCCertsURL is used.
+	URL string
+	// HTTPClient used to fetch the keys. By default, http.DefaultClient is used.
+	HTTPClient *http.Client
+	// CacheTTL defines how long the keys are cached. By default, the keys are cached for an hour.
+	CacheTTL time.Duration
+	// MinRefetchInterval defines how long after fetching the keys they are not fetched again,
+	// even if a token is signed by an unknown key. By default, it's a minute.
+	MinRefetchInterval time.Duration
+
+	lock      sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+	// lastFetchAt and lastFetchErr are the time and the error of the last fetch, also the failed one.
+	lastFetchAt  time.Time
+	lastFetchErr error
+	// fetching is closed when the fetch in progress finishes. It's nil if no fetch is in progress.
+	fetching chan struct{}
+}
+
+// remoteOIDCKeySetFetchTimeout limits a single fetch of the keys, which is shared by all waiting requests.
+const remoteOIDCKeySetFetchTimeout = 10 * time.Second
+
+func (k *RemoteOIDCKeySet) PublicKey(ctx context.Context, keyID string) (*rsa.PublicKey, error) {
+	cacheTTL := k.CacheTTL
+	if cacheTTL == 0 {
+		cacheTTL = time.Hour
+	}
+	minRefetchInterval := k.MinRefetchInterval
+	if minRefetchInterval == 0 {
+		minRefetchInterval = time.Minute
+	}
+
+	for {
+		k.lock.Lock()
+
+		key, ok := k.keys[keyID]
+		if ok && time.Since(k.fetchedAt) < cacheTTL {
+			k.lock.Unlock()
+			return key, nil
+		}
+
+		if time.Since(k.lastFetchAt) < minRefetchInterval {
+			lastFetchErr := k.lastFetchErr
+			k.lock.Unlock()
+
+			if ok {
+				// The keys could not be fetched again, so the expired key is still used.
+				return key, nil
+			}
+			if lastFetchErr != nil {
+				return nil, lastFetchErr
+			}
+			return nil, errors.Errorf("unknown key ID %s", keyID)
+		}
+
+		// The keys are fetched without holding the lock, and all requests wait for the same fetch.
+		if k.fetching == nil {
+			k.fetching = make(chan struct{})
+			go k.refresh(k.fetching)
+		}
+		fetching := k.fetching
+
+		k.lock.Unlock()
+
+		select {
+		case <-fetching:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (k *RemoteOIDCKeySet) refresh(done chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), remoteOIDCKeySetFetchTimeout)
+	defer cancel()
+
+	keys, err := k.fetch(ctx)
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	k.lastFetchAt = time.Now()
+	k.lastFetchErr = err
+	if err == nil {
+		k.keys = keys
+		k.fetchedAt = k.lastFetchAt
+	}
+
+	k.fetching = nil
+	close(done)
+}
+
+type jsonWebKeySet struct {
+	Keys []struct {
+		KeyID     string `json:"kid"`
+		KeyType   string `json:"kty"`
+		Modulus   string `json:"n"`
+		Exponent  string `json:"e"`
+		Algorithm string `json:"alg"`
+	} `json:"keys"`
+}
+
+func (k *RemoteOIDCKeySet) fetch(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	url := k.URL
+	if url == "" {
+		url = GoogleOIDCCertsURL
+	}
+	client := k.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not fetch OIDC keys")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("could not fetch OIDC keys, status: %s", resp.Status)
+	}
+
+	var keySet jsonWebKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&keySet); err != nil {
+		return nil, errors.Wrap(err, "could not decode OIDC keys")
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(keySet.Keys))
+	for _, key := range keySet.Keys {
+		if key.KeyType != "RSA" {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(key.Modulus)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid modulus of key %s", key.KeyID)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(key.Exponent)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid exponent of key %s", key.KeyID)
+		}
+
+		keys[key.KeyID] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	return keys, nil
+}
+
+// OIDCTokenVerifierConfig configures the verification of OIDC tokens sent with push requests.
+// See https://cloud.google.com/pubsub/docs/authenticate-push-subscriptions.
+type OIDCTokenVerifierConfig struct {
+	// Audience is the expected audience of the token, as configured in the push subscription.
+	// By default, Pub/Sub uses the push endpoint URL as the audience.
+	Audience string
+
+	// ServiceAccountEmail, if set, is the expected email of the service account that the token was issued for.
+	ServiceAccountEmail string
+
+	// KeySet provides the keys used to verify the token signature.
+	// By default, the keys are fetched from GoogleOIDCCertsURL.
+	KeySet OIDCKeySet
+
+	// Issuers are the accepted issuers of the token.
+	// By default, "accounts.google.com" and "https://accounts.google.com" are accepted.
+	Issuers []string
+}
+
+func (c *OIDCTokenVerifierConfig) setDefaults() {
+	if c.KeySet == nil {
+		c.KeySet = &RemoteOIDCKeySet{}
+	}
+	if len(c.Issuers) == 0 {
+		c.Issuers = []string{"accounts.google.com", "https://accounts.google.com"}
+	}
+}
+
+func (c OIDCTokenVerifierConfig) validate() error {
+	if c.Audience == "" {
+		return errors.New("audience is required")
+	}
+
+	return nil
+}
+
+// OIDCTokenVerifier verifies the RS256-signed OIDC tokens that Pub/Sub sends with push requests.
+type OIDCTokenVerifier struct {
+	config OIDCTokenVerifierConfig
+}
+
+func NewOIDCTokenVerifier(config OIDCTokenVerifierConfig) (*OIDCTokenVerifier, error) {
+	config.setDefaults()
+	if err := config.validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid config")
+	}
+
+	return &OIDCTokenVerifier{config: config}, nil
+}
+
+type oidcHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+// oidcAudience is the aud claim, which may be a single string or an array of strings.
+type oidcAudience []string
+
+func (a *oidcAudience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = oidcAudience{single}
+		return nil
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(b, &multiple); err != nil {
+		return errors.Wrap(err, "aud must be a string or an array of strings")
+	}
+	*a = multiple
+
+	return nil
+}
+
+func (a oidcAudience) contains(audience string) bool {
+	for _, aud := range a {
+		if aud == audience {
+			return true
+		}
+	}
+
+	return false
+}
+
+type oidcClaims struct {
+	Issuer        string       `json:"iss"`
+	Audience      oidcAudience `json:"aud"`
+	ExpiresAt     int64        `json:"exp"`
+	IssuedAt      int64        `json:"iat"`
+	Email         string       `json:"email"`
+	EmailVerified bool         `json:"email_verified"`
+}
+
+func (v *OIDCTokenVerifier) VerifyPushToken(ctx context.Context, token string) error {
+	if err := v.verify(ctx, token); err != nil {
+		return errors.Wrap(ErrInvalidPushToken, err.Error())
+	}
+
+	return nil
+}
+
+func (v *OIDCTokenVerifier) verify(ctx context.Context, token string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed token")
+	}
+
+	var header oidcHeader
+	if err := decodeTokenPart(parts[0], &header); err != nil {
+		return errors.Wrap(err, "invalid header")
+	}
+	if header.Algorithm != "RS256" {
+		return errors.Errorf("unsupported algorithm %s", header.Algorithm)
+	}
+
+	key, err := v.config.KeySet.PublicKey(ctx, header.KeyID)
+	if err != nil {
+		return err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return errors.Wrap(err, "invalid signature encoding")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return errors.Wrap(err, "invalid signature")
+	}
+
+	var claims oidcClaims
+	if err := decodeTokenPart(parts[1], &claims); err != nil {
+		return errors.Wrap(err, "invalid claims")
+	}
+
+	return v.verifyClaims(claims)
+}
+
+func (v *OIDCTokenVerifier) verifyClaims(claims oidcClaims) error {
+	validIssuer := false
+	for _, issuer := range v.config.Issuers {
+		if claims.Issuer == issuer {
+			validIssuer = true
+			break
+		}
+	}
+	if !validIssuer {
+		return errors.Errorf("unexpected issuer %s", claims.Issuer)
+	}
+
+	if !claims.Audience.contains(v.config.Audience) {
+		return errors.Errorf("unexpected audience %s", strings.Join(claims.Audience, ", "))
+	}
+
+	now := time.Now()
+	if now.Add(-oidcClockSkew).After(time.Unix(claims.ExpiresAt, 0)) {
+		return errors.New("token expired")
+	}
+	if now.Add(oidcClockSkew).Before(time.Unix(claims.IssuedAt, 0)) {
+		return errors.New("token issued in the future")
+	}
+
+	if v.config.ServiceAccountEmail != "" {
+		if claims.Email != v.config.ServiceAccountEmail || !claims.EmailVerified {
+			return errors.Errorf("unexpected email %s", claims.Email)
+		}
+	}
+
+	return nil
+}
+
+func decodeTokenPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,326 @@
+package googlecloud
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/pkg/errors"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// ErrAlreadySubscribed happens when subscribing to a topic whose push subscription already has a consumer.
+var ErrAlreadySubscribed = errors.New("push subscription already has a consumer")
+
+// maxPushRequestSize limits the body of a push request. Pub/Sub messages are up to 10 MB,
+// and their data is base64-encoded in the push request, so it's a little above the encoded size of the largest message.
+const maxPushRequestSize = 14 << 20
+
+// PushSubscriber receives messages from Google Cloud Pub/Sub push subscriptions over HTTP
+// and outputs them on Go channels, like Subscriber does for pull subscriptions.
+//
+// PushSubscriber doesn't create the push subscriptions. Use Subscriber with SubscriptionConfig.PushConfig for that.
+// The endpoint of the subscriptions must be served by the handler returned by Handler.
+// A single handler may serve multiple push subscriptions, messages are routed by the subscription name.
+//
+// A message acked by the consumer is acknowledged with a 2xx response, and a nacked message with a non-2xx response,
+// so Pub/Sub redelivers it.
+//
+// See https://cloud.google.com/pubsub/docs/push to find out more about how Google Cloud Pub/Sub push subscriptions work.
+type PushSubscriber struct {
+	closing    chan struct{}
+	closed     bool
+	closedLock sync.Mutex
+
+	allSubscriptionsWaitGroup sync.WaitGroup
+	subscriptions             map[string]*pushSubscription
+	subscriptionsLock         sync.RWMutex
+
+	config PushSubscriberConfig
+
+	logger watermill.LoggerAdapter
+}
+
+type pushSubscription struct {
+	output chan *message.Message
+	// done is closed before output, so messages that are being delivered are not blocked on it.
+	done chan struct{}
+	// outputLock is held for reading while a message is sent to output, so output is not closed in the meantime.
+	outputLock sync.RWMutex
+}
+
+type PushSubscriberConfig struct {
+	// GenerateSubscriptionName generates subscription name for a given topic.
+	// It must generate the same names as the Subscriber that created the push subscriptions.
+	GenerateSubscriptionName SubscriptionNameFn
+
+	// TokenVerifier, if set, verifies the bearer token that Pub/Sub sends with every push request.
+	// Requests without a valid token are rejected with 401 Unauthorized.
+	// Use NewOIDCTokenVerifier to verify the OIDC tokens of push subscriptions with authentication enabled.
+	TokenVerifier PushTokenVerifier
+
+	// Unmarshaler transforms the client library format into watermill/message.Message.
+	// The push request is decoded into pubsub.Message before it's unmarshaled,
+	// so the same Unmarshaler as for Subscriber may be used.
+	Unmarshaler Unmarshaler
+}
+
+func (c *PushSubscriberConfig) setDefaults() {
+	if c.GenerateSubscriptionName == nil {
+		c.GenerateSubscriptionName = TopicSubscriptionName
+	}
+	if c.Unmarshaler == nil {
+		c.Unmarshaler = DefaultMarshalerUnmarshaler{}
+	}
+}
+
+func NewPushSubscriber(config PushSubscriberConfig, logger watermill.LoggerAdapter) (*PushSubscriber, error) {
+	config.setDefaults()
+
+	if logger == nil {
+		logger = watermill.NopLogger{}
+	}
+
+	return &PushSubscriber{
+		closing:       make(chan struct{}),
+		subscriptions: map[string]*pushSubscription{},
+		config:        config,
+		logger:        logger,
+	}, nil
+}
+
+// Subscribe returns a channel with messages pushed to the subscription of the topic.
+// The topic is transformed into the subscription name with the configured `GenerateSubscriptionName` function.
+//
+// The channel is closed when ctx is canceled or the PushSubscriber is closed.
+// A subscription may have a single consumer at a time, otherwise ErrAlreadySubscribed is returned.
+func (s *PushSubscriber) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	if s.getClosed() {
+		return nil, ErrSubscriberClosed
+	}
+
+	subscriptionName := s.config.GenerateSubscriptionName(topic)
+
+	logFields := watermill.LogFields{
+		"provider":          ProviderName,
+		"topic":             topic,
+		"subscription_name": subscriptionName,
+	}
+
+	s.subscriptionsLock.Lock()
+	defer s.subscriptionsLock.Unlock()
+
+	if _, ok := s.subscriptions[subscriptionName]; ok {
+		return nil, errors.Wrap(ErrAlreadySubscribed, subscriptionName)
+	}
+
+	sub := &pushSubscription{
+		output: make(chan *message.Message),
+		done:   make(chan struct{}),
+	}
+	s.subscriptions[subscriptionName] = sub
+
+	s.logger.Info("Subscribing to Google Cloud PubSub push subscription", logFields)
+
+	s.allSubscriptionsWaitGroup.Add(1)
+	go func() {
+		defer s.allSubscriptionsWaitGroup.Done()
+
+		select {
+		case <-s.closing:
+		case <-ctx.Done():
+		}
+
+		close(sub.done)
+
+		s.subscriptionsLock.Lock()
+		delete(s.subscriptions, subscriptionName)
+		s.subscriptionsLock.Unlock()
+
+		sub.outputLock.Lock()
+		close(sub.output)
+		sub.outputLock.Unlock()
+
+		s.logger.Debug("Push subscription closed", logFields)
+	}()
+
+	return sub.output, nil
+}
+
+// Close stops receiving pushed messages and closes all the output channels.
+// Requests received after Close are responded with 503 Service Unavailable.
+func (s *PushSubscriber) Close() error {
+	if s.getClosed() {
+		return nil
+	}
+
+	s.setClosed(true)
+	close(s.closing)
+	s.allSubscriptionsWaitGroup.Wait()
+
+	s.logger.Debug("Google Cloud PubSub push subscriber closed", nil)
+
+	return nil
+}
+
+// Handler returns the http.Handler that receives the push requests.
+func (s *PushSubscriber) Handler() http.Handler {
+	return http.HandlerFunc(s.handlePush)
+}
+
+// pushRequest is the JSON body of a push request.
+// See https://cloud.google.com/pubsub/docs/push#receive_push.
+type pushRequest struct {
+	Message struct {
+		Attributes  map[string]string `json:"attributes"`
+		Data        []byte            `json:"data"`
+		MessageID   string            `json:"messageId"`
+		PublishTime time.Time         `json:"publishTime"`
+		OrderingKey string            `json:"orderingKey"`
+	} `json:"message"`
+	Subscription    string `json:"subscription"`
+	DeliveryAttempt *int   `json:"deliveryAttempt"`
+}
+
+func (r pushRequest) subscriptionName() string {
+	return r.Subscription[strings.LastIndex(r.Subscription, "/")+1:]
+}
+
+func (r pushRequest) pubsubMessage() *pubsub.Message {
+	return &pubsub.Message{
+		ID:              r.Message.MessageID,
+		Data:            r.Message.Data,
+		Attributes:      r.Message.Attributes,
+		PublishTime:     r.Message.PublishTime,
+		OrderingKey:     r.Message.OrderingKey,
+		DeliveryAttempt: r.DeliveryAttempt,
+	}
+}
+
+func (s *PushSubscriber) handlePush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.getClosed() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	if s.config.TokenVerifier != nil {
+		if err := s.verifyToken(r); err != nil {
+			s.logger.Error("Push request is not authorized", err, nil)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	var req pushRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPushRequestSize)).Decode(&req); err != nil {
+		s.logger.Error("Could not decode push request", err, nil)
+
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	subscriptionName := req.subscriptionName()
+	logFields := watermill.LogFields{
+		"provider":          ProviderName,
+		"subscription_name": subscriptionName,
+		"message_id":        req.Message.MessageID,
+	}
+
+	msg, err := s.config.Unmarshaler.Unmarshal(req.pubsubMessage())
+	if err != nil {
+		s.logger.Error("Could not unmarshal Google Cloud PubSub message", err, logFields)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	logFields["message_uuid"] = msg.UUID
+
+	ctx, cancelCtx := context.WithCancel(r.Context())
+	defer cancelCtx()
+	msg.SetContext(ctx)
+
+	w.WriteHeader(s.deliver(ctx, subscriptionName, msg, logFields))
+}
+
+// deliver sends the message to the output of the subscription and waits for the ack or nack.
+// It returns the status code of the response to the push request.
+func (s *PushSubscriber) deliver(ctx context.Context, subscriptionName string, msg *message.Message, logFields watermill.LogFields) int {
+	s.subscriptionsLock.RLock()
+	sub, ok := s.subscriptions[subscriptionName]
+	s.subscriptionsLock.RUnlock()
+	if !ok {
+		s.logger.Info("Message not consumed, no consumer for subscription", logFields)
+		return http.StatusNotFound
+	}
+
+	// Only the lock of this subscription is held until the message is consumed,
+	// so a slow consumer doesn't block the other subscriptions.
+	sub.outputLock.RLock()
+	select {
+	case <-sub.done:
+		sub.outputLock.RUnlock()
+		s.logger.Info("Message not consumed, subscription is closing", logFields)
+		return http.StatusServiceUnavailable
+	case <-ctx.Done():
+		sub.outputLock.RUnlock()
+		s.logger.Info("Message not consumed, ctx canceled", logFields)
+		return http.StatusServiceUnavailable
+	case sub.output <- msg:
+		sub.outputLock.RUnlock()
+		// message consumed, wait for ack (or nack)
+	}
+
+	select {
+	case <-sub.done:
+		s.logger.Trace("Closing, nacking message", logFields)
+		return http.StatusServiceUnavailable
+	case <-ctx.Done():
+		s.logger.Trace("Ctx done, nacking message", logFields)
+		return http.StatusServiceUnavailable
+	case <-msg.Acked():
+		s.logger.Trace("Msg acked", logFields)
+		return http.StatusNoContent
+	case <-msg.Nacked():
+		s.logger.Trace("Msg nacked", logFields)
+		return http.StatusInternalServerError
+	}
+}
+
+func (s *PushSubscriber) verifyToken(r *http.Request) error {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return errors.Wrap(ErrInvalidPushToken, "missing bearer token")
+	}
+
+	return s.config.TokenVerifier.VerifyPushToken(r.Context(), token)
+}
+
+func (s *PushSubscriber) setClosed(value bool) {
+	s.closedLock.Lock()
+	defer s.closedLock.Unlock()
+
+	s.closed = value
+}
+
+func (s *PushSubscriber) getClosed() bool {
+	s.closedLock.Lock()
+	defer s.closedLock.Unlock()
+
+	return s.closed
+}
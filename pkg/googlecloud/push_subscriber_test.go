@@ -0,0 +1,276 @@
+package googlecloud_test
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ThreeDotsLabs/watermill"
+
+	"github.com/ThreeDotsLabs/watermill-googlecloud/pkg/googlecloud"
+)
+
+const pushTestAudience = "https://example.com/push"
+
+func signPushToken(t *testing.T, key *rsa.PrivateKey, keyID string, claims map[string]interface{}) string {
+	encode := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		require.NoError(t, err)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	signed := encode(map[string]string{"alg": "RS256", "kid": keyID, "typ": "JWT"}) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func newPushRequest(t *testing.T, subscription string, data []byte, attributes map[string]string) *http.Request {
+	body, err := json.Marshal(map[string]interface{}{
+		"message": map[string]interface{}{
+			"attributes":  attributes,
+			"data":        data,
+			"messageId":   "123",
+			"publishTime": time.Now().Format(time.RFC3339Nano),
+		},
+		"subscription":    "projects/tests/subscriptions/" + subscription,
+		"deliveryAttempt": 2,
+	})
+	require.NoError(t, err)
+
+	return httptest.NewRequest(http.MethodPost, "/push", bytes.NewReader(body))
+}
+
+func TestPushSubscriber(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	verifier, err := googlecloud.NewOIDCTokenVerifier(googlecloud.OIDCTokenVerifierConfig{
+		Audience:            pushTestAudience,
+		ServiceAccountEmail: "push@tests.iam.gserviceaccount.com",
+		KeySet:              googlecloud.StaticOIDCKeySet{"test-key": &key.PublicKey},
+	})
+	require.NoError(t, err)
+
+	sub, err := googlecloud.NewPushSubscriber(googlecloud.PushSubscriberConfig{
+		TokenVerifier: verifier,
+	}, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	messages, err := sub.Subscribe(ctx, "topic")
+	require.NoError(t, err)
+
+	_, err = sub.Subscribe(ctx, "topic")
+	assert.ErrorIs(t, err, googlecloud.ErrAlreadySubscribed)
+
+	validToken := signPushToken(t, key, "test-key", map[string]interface{}{
+		"iss":            "https://accounts.google.com",
+		"aud":            pushTestAudience,
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+		"email":          "push@tests.iam.gserviceaccount.com",
+		"email_verified": true,
+	})
+
+	push := func(req *http.Request, token string) <-chan int {
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		statusCode := make(chan int, 1)
+		go func() {
+			rec := httptest.NewRecorder()
+			sub.Handler().ServeHTTP(rec, req)
+			statusCode <- rec.Code
+		}()
+
+		return statusCode
+	}
+
+	testCases := []struct {
+		name               string
+		ack                bool
+		expectedStatusCode int
+	}{
+		{name: "ack", ack: true, expectedStatusCode: http.StatusNoContent},
+		{name: "nack", ack: false, expectedStatusCode: http.StatusInternalServerError},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			uuid := watermill.NewUUID()
+			statusCode := push(newPushRequest(t, "topic", []byte("payload"), map[string]string{
+				googlecloud.UUIDHeaderKey: uuid,
+				"key":                     "value",
+			}), validToken)
+
+			select {
+			case msg := <-messages:
+				assert.Equal(t, uuid, msg.UUID)
+				assert.Equal(t, "payload", string(msg.Payload))
+				assert.Equal(t, "value", msg.Metadata.Get("key"))
+				assert.Equal(t, "123", msg.Metadata.Get(googlecloud.GoogleMessageIDHeaderKey))
+				assert.Equal(t, "2", msg.Metadata.Get(googlecloud.DeliveryAttemptHeaderKey))
+				if tc.ack {
+					msg.Ack()
+				} else {
+					msg.Nack()
+				}
+			case <-ctx.Done():
+				t.Fatal("timeout")
+			}
+
+			assert.Equal(t, tc.expectedStatusCode, <-statusCode)
+		})
+	}
+
+	t.Run("unknown_subscription", func(t *testing.T) {
+		statusCode := push(newPushRequest(t, "other", nil, nil), validToken)
+		assert.Equal(t, http.StatusNotFound, <-statusCode)
+	})
+
+	t.Run("too_large", func(t *testing.T) {
+		statusCode := push(newPushRequest(t, "topic", make([]byte, 12<<20), nil), validToken)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, <-statusCode)
+	})
+
+	t.Run("missing_token", func(t *testing.T) {
+		statusCode := push(newPushRequest(t, "topic", nil, nil), "")
+		assert.Equal(t, http.StatusUnauthorized, <-statusCode)
+	})
+
+	t.Run("wrong_audience", func(t *testing.T) {
+		token := signPushToken(t, key, "test-key", map[string]interface{}{
+			"iss":            "https://accounts.google.com",
+			"aud":            "https://example.com/other",
+			"exp":            time.Now().Add(time.Hour).Unix(),
+			"iat":            time.Now().Unix(),
+			"email":          "push@tests.iam.gserviceaccount.com",
+			"email_verified": true,
+		})
+		statusCode := push(newPushRequest(t, "topic", nil, nil), token)
+		assert.Equal(t, http.StatusUnauthorized, <-statusCode)
+	})
+
+	t.Run("expired_token", func(t *testing.T) {
+		token := signPushToken(t, key, "test-key", map[string]interface{}{
+			"iss":            "https://accounts.google.com",
+			"aud":            pushTestAudience,
+			"exp":            time.Now().Add(-time.Hour).Unix(),
+			"iat":            time.Now().Add(-2 * time.Hour).Unix(),
+			"email":          "push@tests.iam.gserviceaccount.com",
+			"email_verified": true,
+		})
+		statusCode := push(newPushRequest(t, "topic", nil, nil), token)
+		assert.Equal(t, http.StatusUnauthorized, <-statusCode)
+	})
+
+	t.Run("invalid_signature", func(t *testing.T) {
+		otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+
+		token := signPushToken(t, otherKey, "test-key", map[string]interface{}{
+			"iss":            "https://accounts.google.com",
+			"aud":            pushTestAudience,
+			"exp":            time.Now().Add(time.Hour).Unix(),
+			"iat":            time.Now().Unix(),
+			"email":          "push@tests.iam.gserviceaccount.com",
+			"email_verified": true,
+		})
+		statusCode := push(newPushRequest(t, "topic", nil, nil), token)
+		assert.Equal(t, http.StatusUnauthorized, <-statusCode)
+	})
+
+	require.NoError(t, sub.Close())
+
+	_, ok := <-messages
+	assert.False(t, ok, "output channel should be closed")
+
+	statusCode := push(newPushRequest(t, "topic", nil, nil), validToken)
+	assert.Equal(t, http.StatusServiceUnavailable, <-statusCode)
+}
+
+func TestOIDCTokenVerifierAudienceArray(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	verifier, err := googlecloud.NewOIDCTokenVerifier(googlecloud.OIDCTokenVerifierConfig{
+		Audience: pushTestAudience,
+		KeySet:   googlecloud.StaticOIDCKeySet{"test-key": &key.PublicKey},
+	})
+	require.NoError(t, err)
+
+	token := func(aud interface{}) string {
+		return signPushToken(t, key, "test-key", map[string]interface{}{
+			"iss": "https://accounts.google.com",
+			"aud": aud,
+			"exp": time.Now().Add(time.Hour).Unix(),
+			"iat": time.Now().Unix(),
+		})
+	}
+
+	assert.NoError(t, verifier.VerifyPushToken(context.Background(), token([]string{"https://example.com/other", pushTestAudience})))
+	assert.ErrorIs(t, verifier.VerifyPushToken(context.Background(), token([]string{"https://example.com/other"})), googlecloud.ErrInvalidPushToken)
+}
+
+func TestRemoteOIDCKeySetUnknownKeyID(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kid": "test-key",
+				"kty": "RSA",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	}))
+	defer server.Close()
+
+	keySet := &googlecloud.RemoteOIDCKeySet{URL: server.URL}
+	ctx := context.Background()
+
+	publicKey, err := keySet.PublicKey(ctx, "test-key")
+	require.NoError(t, err)
+	assert.Equal(t, key.N, publicKey.N)
+
+	// Unknown key IDs don't make the keys fetched again within MinRefetchInterval.
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := keySet.PublicKey(ctx, fmt.Sprintf("unknown-key-%d", i))
+			assert.Error(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	assert.EqualValues(t, 1, fetches.Load())
+}
@@ -0,0 +1,113 @@
+package googlecloud
+
+import (
+	"context"
+	"time"
+
+	"github.com/cenkalti/backoff/v3"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/ThreeDotsLabs/watermill"
+)
+
+// ReceiveBackoffFn returns the policy of retrying to receive messages after receiving failed.
+// It's called for every Subscribe call, so the returned BackOff must not be shared.
+type ReceiveBackoffFn func() backoff.BackOff
+
+// DefaultReceiveBackoff retries receiving messages with an exponential backoff that never stops retrying.
+func DefaultReceiveBackoff() backoff.BackOff {
+	exponentialBackoff := backoff.NewExponentialBackOff()
+	exponentialBackoff.MaxElapsedTime = 0 // 0 means it never expires
+
+	return exponentialBackoff
+}
+
+// PermanentReceiveErrorFn returns true if receiving messages failed with an error that retrying won't fix.
+type PermanentReceiveErrorFn func(err error) bool
+
+// IsPermanentReceiveError treats the errors with the NotFound (the subscription was deleted),
+// PermissionDenied (the permission to the subscription was revoked)
+// and FailedPrecondition (for example, the subscription was detached from the topic) gRPC codes as permanent.
+func IsPermanentReceiveError(err error) bool {
+	switch status.Code(errors.Cause(err)) {
+	case codes.NotFound, codes.PermissionDenied, codes.FailedPrecondition:
+		return true
+	default:
+		return false
+	}
+}
+
+// receiveEstablishedAfter is how long a retried receive must run without failing to be reported as receiving again.
+const receiveEstablishedAfter = 10 * time.Second
+
+// ReceiveErrorFn is called when `Subscriber` stops receiving messages of the topic because of err.
+type ReceiveErrorFn func(topic string, err error)
+
+// receiveWithRetry calls receive until it returns with no error, ctx is canceled,
+// the error is permanent or the backoff policy stops retrying.
+// It returns the error that made it stop retrying.
+//
+// If SubscriberConfig.RecreateDeletedSubscription is enabled and the subscription was not found,
+// the subscription is provisioned again before retrying.
+func (s *Subscriber) receiveWithRetry(
+	ctx context.Context,
+	consumer *subscriptionConsumer,
+	receive func() error,
+	logFields watermill.LogFields,
+) error {
+	attempt := 0
+
+	return backoff.Retry(func() error {
+		attempt++
+
+		// Receiving doesn't signal that it was established, so a retried receive is reported as receiving
+		// only once it didn't fail for a while.
+		var established *time.Timer
+		if attempt > 1 {
+			retriedAttempt := attempt
+			established = time.AfterFunc(receiveEstablishedAfter, func() {
+				s.health.established(consumer, retriedAttempt)
+			})
+		}
+		err := receive()
+		if established != nil {
+			established.Stop()
+		}
+		if err == nil {
+			s.logger.Info("Receiving messages finished with no error", logFields)
+			return nil
+		}
+
+		if s.getClosed() {
+			s.logger.Info("Receiving messages failed while closed", logFields)
+			return backoff.Permanent(err)
+		}
+
+		recreate := s.config.RecreateDeletedSubscription && !s.config.DoNotCreateSubscriptionIfMissing
+		if recreate && status.Code(errors.Cause(err)) == codes.NotFound {
+			s.logger.Error("Subscription was deleted or expired, recreating it", err, logFields)
+
+			if recreateErr := s.reprovisionSubscription(ctx, consumer); recreateErr != nil {
+				err = errors.Wrap(recreateErr, "could not recreate subscription")
+			} else {
+				s.logger.Info("Subscription recreated, resuming receiving messages", logFields)
+				s.config.Metrics.ReceiveRestarted(ctx, consumer.topic, consumer.subscriptionName, err)
+				s.health.retrying(consumer, err, attempt)
+				return err
+			}
+		}
+
+		if s.config.PermanentReceiveError(err) {
+			return backoff.Permanent(errors.Wrap(err, "receiving messages failed permanently"))
+		}
+
+		s.logger.Error("Receiving messages failed, retrying", err, logFields.Add(watermill.LogFields{
+			"attempt": attempt,
+		}))
+		s.config.Metrics.ReceiveRestarted(ctx, consumer.topic, consumer.subscriptionName, err)
+		s.health.retrying(consumer, err, attempt)
+		return err
+	}, backoff.WithContext(s.config.ReceiveBackoff(), ctx))
+}
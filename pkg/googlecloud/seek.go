@@ -0,0 +1,201 @@
+package googlecloud
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/pkg/errors"
+	"google.golang.org/api/iterator"
+
+	"github.com/ThreeDotsLabs/watermill"
+)
+
+// StartFrom defines where the Subscriber seeks a subscription to when it starts using it.
+// Only one of the fields may be set. The zero value doesn't seek the subscription.
+//
+// See https://cloud.google.com/pubsub/docs/replay-overview to find out more about seeking.
+type StartFrom struct {
+	// Time, if set, marks all messages published after Time as unacknowledged, and the ones published before as acknowledged.
+	// Acknowledged messages can be replayed only if the subscription retains them (SubscriptionConfig.RetainAckedMessages).
+	Time time.Time
+
+	// Snapshot, if set, is the name of the snapshot the subscription is seeked to.
+	Snapshot string
+}
+
+func (f StartFrom) isZero() bool {
+	return f.Time.IsZero() && f.Snapshot == ""
+}
+
+func (f StartFrom) validate() error {
+	if !f.Time.IsZero() && f.Snapshot != "" {
+		return errors.New("only one of StartFrom.Time and StartFrom.Snapshot may be set")
+	}
+
+	return nil
+}
+
+func (s *Subscriber) startFrom(ctx context.Context, client *pubsub.Client, sub *pubsub.Subscription, topicName, subscriptionName string) error {
+	startFrom := s.config.StartFrom
+	if startFrom.isZero() {
+		return nil
+	}
+
+	logFields := watermill.LogFields{
+		"provider":          ProviderName,
+		"topic":             topicName,
+		"subscription_name": subscriptionName,
+	}
+
+	if startFrom.Snapshot != "" {
+		if err := sub.SeekToSnapshot(ctx, client.Snapshot(startFrom.Snapshot)); err != nil {
+			return errors.Wrapf(err, "could not seek subscription %s to snapshot %s", subscriptionName, startFrom.Snapshot)
+		}
+		s.logger.Info("Seeked subscription to snapshot", logFields.Add(watermill.LogFields{"snapshot": startFrom.Snapshot}))
+		return nil
+	}
+
+	if err := sub.SeekToTime(ctx, startFrom.Time); err != nil {
+		return errors.Wrapf(err, "could not seek subscription %s to %s", subscriptionName, startFrom.Time)
+	}
+	s.logger.Info("Seeked subscription to time", logFields.Add(watermill.LogFields{"time": startFrom.Time}))
+
+	return nil
+}
+
+// SeekToTime seeks the subscription of the topic to t.
+// All messages published after t are marked as unacknowledged and redelivered,
+// and all messages published before t are marked as acknowledged.
+//
+// The topic is transformed into subscription name with the configured `GenerateSubscriptionName` function.
+// The subscription must exist, for example created with SubscribeInitialize.
+func (s *Subscriber) SeekToTime(ctx context.Context, topic string, t time.Time) error {
+	sub, subscriptionName, err := s.adminSubscription(ctx, topic)
+	if err != nil {
+		return err
+	}
+
+	if err := sub.SeekToTime(ctx, t); err != nil {
+		return errors.Wrapf(err, "could not seek subscription %s to %s", subscriptionName, t)
+	}
+
+	return nil
+}
+
+// CreateSnapshot creates a snapshot of the subscription of the topic, which retains its unacknowledged messages.
+// If name is empty, a unique name is generated by the server.
+//
+// The topic is transformed into subscription name with the configured `GenerateSubscriptionName` function.
+// The subscription must exist, for example created with SubscribeInitialize.
+func (s *Subscriber) CreateSnapshot(ctx context.Context, topic, name string) (*pubsub.SnapshotConfig, error) {
+	sub, subscriptionName, err := s.adminSubscription(ctx, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := sub.CreateSnapshot(ctx, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not create snapshot of subscription %s", subscriptionName)
+	}
+
+	return config, nil
+}
+
+// SeekToSnapshot seeks the subscription of the topic to the snapshot with the name.
+// Messages that were unacknowledged when the snapshot was created, and messages published after it, are redelivered.
+//
+// The topic is transformed into subscription name with the configured `GenerateSubscriptionName` function.
+// The subscription must exist, for example created with SubscribeInitialize.
+func (s *Subscriber) SeekToSnapshot(ctx context.Context, topic, name string) error {
+	sub, subscriptionName, err := s.adminSubscription(ctx, topic)
+	if err != nil {
+		return err
+	}
+
+	client, err := s.adminClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := sub.SeekToSnapshot(ctx, client.Snapshot(name)); err != nil {
+		return errors.Wrapf(err, "could not seek subscription %s to snapshot %s", subscriptionName, name)
+	}
+
+	return nil
+}
+
+// ListSnapshots returns the snapshots of the topic in the project.
+func (s *Subscriber) ListSnapshots(ctx context.Context, topic string) ([]*pubsub.SnapshotConfig, error) {
+	client, err := s.adminClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	fullyQualifiedTopicName := fmt.Sprintf("projects/%s/topics/%s", s.config.topicProjectID(), topic)
+
+	var snapshots []*pubsub.SnapshotConfig
+	it := client.Snapshots(ctx)
+	for {
+		snapshot, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "could not list snapshots")
+		}
+
+		if snapshot.Topic != nil && snapshot.Topic.String() == fullyQualifiedTopicName {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+
+	return snapshots, nil
+}
+
+// DeleteSnapshot deletes the snapshot with the name.
+func (s *Subscriber) DeleteSnapshot(ctx context.Context, name string) error {
+	client, err := s.adminClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := client.Snapshot(name).Delete(ctx); err != nil {
+		return errors.Wrapf(err, "could not delete snapshot %s", name)
+	}
+
+	return nil
+}
+
+// adminSubscription returns the subscription of the topic for operations like seeking, and its name.
+// Unlike the subscriptions used by Subscribe, it's not provisioned, StartFrom is not applied to it, and it's not cached.
+func (s *Subscriber) adminSubscription(ctx context.Context, topic string) (*pubsub.Subscription, string, error) {
+	client, err := s.adminClient(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	subscriptionName := s.config.GenerateSubscriptionName(topic)
+
+	return client.Subscription(subscriptionName), subscriptionName, nil
+}
+
+// adminClient returns the client used for operations that are not bound to a subscription.
+// It's created on first use and closed with the Subscriber.
+func (s *Subscriber) adminClient(ctx context.Context) (*pubsub.Client, error) {
+	s.adminLock.Lock()
+	defer s.adminLock.Unlock()
+
+	if s.admin != nil {
+		return s.admin, nil
+	}
+
+	client, err := s.newClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.admin = client
+
+	return client, nil
+}
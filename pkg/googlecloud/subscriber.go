@@ -8,7 +8,7 @@ import (
 	"time"
 
 	"cloud.google.com/go/pubsub"
-	"github.com/cenkalti/backoff/v3"
+	vkit "cloud.google.com/go/pubsub/apiv1"
 	"github.com/hashicorp/go-multierror"
 	"github.com/pkg/errors"
 	"google.golang.org/api/option"
@@ -38,12 +38,22 @@ type Subscriber struct {
 	closedLock sync.Mutex
 
 	allSubscriptionsWaitGroup sync.WaitGroup
-	activeSubscriptions       map[string]*pubsub.Subscription
+	inFlight                  *inFlightMessages
+	health                    *subscriptionsHealth
+	activeSubscriptions       map[string]*activeSubscription
 	activeSubscriptionsLock   sync.RWMutex
+	// startedFrom are the names of the subscriptions StartFrom was already applied to.
+	// Unlike activeSubscriptions, it's never pruned, so StartFrom is applied once per subscription.
+	// It's guarded by activeSubscriptionsLock.
+	startedFrom map[string]struct{}
 
 	clients     []*pubsub.Client
+	apiClient   *vkit.SubscriberClient
 	clientsLock sync.RWMutex
 
+	admin     *pubsub.Client
+	adminLock sync.Mutex
+
 	config SubscriberConfig
 
 	logger watermill.LoggerAdapter
@@ -72,32 +82,143 @@ type SubscriberConfig struct {
 	DoNotCreateSubscriptionIfMissing bool
 
 	// If false (default), `Subscriber` tries to update a subscription endpoint the requested endpoint is not the same as the current one.
+	// It is not used if SubscriptionConfigDriftPolicies contains SubscriptionConfigFieldPushEndpoint.
 	DoNotUpdateSubscriptionIfEndpointChanged bool
 
 	// If true, `Subscriber` tries to recreate a subscription if the filter is changed.
+	// It is not used if SubscriptionConfigDriftPolicies contains SubscriptionConfigFieldFilter.
 	RecreateSubscriptionIfFilterChanged bool
 
+	// RecreateSubscriptionMode defines how `Subscriber` recreates a subscription.
+	// By default, the subscription is deleted and created again, so the messages it hasn't acked are lost.
+	// Use SubscriptionRecreatePreserveBacklog to keep them.
+	RecreateSubscriptionMode SubscriptionRecreateMode
+
+	// If true, `Subscriber` only logs that a subscription would be recreated and keeps the existing subscription.
+	RecreateSubscriptionDryRun bool
+
+	// SubscriptionConfigDriftPolicies defines what `Subscriber` does when a field of an existing subscription's config
+	// differs from SubscriptionConfig. Every difference is logged.
+	// Fields not present in the map are ignored, except for the filter and the push endpoint,
+	// which follow RecreateSubscriptionIfFilterChanged and DoNotUpdateSubscriptionIfEndpointChanged,
+	// and the dead-letter policy, which is updated if DeadLetter is set.
+	SubscriptionConfigDriftPolicies map[SubscriptionConfigField]SubscriptionConfigDriftPolicy
+
 	// If false (default), `Subscriber` tries to create a topic if there is none with the requested name
 	// and it is trying to create a new subscription with this topic name.
 	// Otherwise, trying to create a subscription on non-existent topic results in `ErrTopicDoesNotExist`.
 	DoNotCreateTopicIfMissing bool
 
+	// TopicConfig is used to create topics that don't exist yet.
+	// It is not used if TopicConfigFn is set.
+	TopicConfig pubsub.TopicConfig
+	// TopicConfigFn returns the config used to create a topic that doesn't exist yet.
+	// By default, TopicConfig is used for all topics.
+	TopicConfigFn TopicConfigFn
+
 	// deprecated: ConnectTimeout is no longer used, please use timeout on context in Subscribe() method
 	ConnectTimeout time.Duration
 
 	// InitializeTimeout defines the timeout for initializing topics.
 	InitializeTimeout time.Duration
 
+	// DeadLetter, if set, makes `Subscriber` create a dead-letter topic with a drain subscription
+	// and set the dead-letter policy of the subscription to it.
+	// It overrides SubscriptionConfig.DeadLetterPolicy. The dead-letter policy of an existing subscription is updated,
+	// unless SubscriptionConfigDriftPolicies contains SubscriptionConfigFieldDeadLetterPolicy.
+	DeadLetter *DeadLetterConfig
+
+	// StartFrom, if set, makes `Subscriber` seek a subscription to a time or a snapshot when it starts using it,
+	// so the messages are replayed from there. It's applied once per subscription, on the first
+	// Subscribe or SubscribeInitialize call.
+	StartFrom StartFrom
+
+	// ReceiveMode defines how `Subscriber` receives messages. By default, ReceiveModeStreamingPull is used.
+	// With ReceiveModeStreamingPull, the ack deadline of a message can't be extended beyond ReceiveSettings.MaxExtension,
+	// even with ExtendAckDeadline. Use ReceiveModeSynchronousPull if handlers need to extend it further.
+	ReceiveMode ReceiveMode
+	// SynchronousPullSettings are used with ReceiveModeSynchronousPull.
+	SynchronousPullSettings SynchronousPullSettings
+
 	// Settings for cloud.google.com/go/pubsub client library.
+	// ReceiveSettings, except for MaxExtension and MaxOutstandingMessages, are not used with ReceiveModeSynchronousPull.
 	ReceiveSettings    pubsub.ReceiveSettings
 	SubscriptionConfig pubsub.SubscriptionConfig
 	ClientOptions      []option.ClientOption
 
+	// Client, if set, is used for all subscriptions instead of creating a client per subscription.
+	// ClientOptions are not used for it. The client is owned by the caller, so `Subscriber` doesn't close it.
+	// If ProjectID is empty, the project of the client is used.
+	// With ReceiveModeSynchronousPull, SynchronousPullSettings.ClientOptions must be set as well.
+	Client *pubsub.Client
+	// ClientPool, if set, provides the client of ProjectID shared by all subscriptions.
+	// It may be shared with other Publishers and Subscribers. `Subscriber` doesn't close its clients.
+	//
+	// Only one of Client and ClientPool may be set.
+	// With ReceiveModeSynchronousPull, the low-level subscriber client of the pool is used,
+	// unless SynchronousPullSettings.ClientOptions are set.
+	ClientPool *ClientPool
+
 	// Unmarshaler transforms the client library format into watermill/message.Message.
 	// Use a custom unmarshaler if needed, otherwise the default Unmarshaler should cover most use cases.
 	Unmarshaler Unmarshaler
+
+	// If SubscriptionConfig.EnableExactlyOnceDelivery is true, `Subscriber` waits for the result of every ack and nack.
+	// OnAckResultError is called when an ack or nack was not successful.
+	// The failure is logged regardless of this callback.
+	OnAckResultError AckResultErrorFn
+
+	// AckResultTimeout defines how long `Subscriber` waits for the result of an ack or nack
+	// with exactly-once delivery enabled or with ReceiveModeSynchronousPull.
+	AckResultTimeout time.Duration
+
+	// AckResultErrorMetadataKey is the metadata key set to the error message when an ack or nack was not successful.
+	// It is set before OnAckResultError is called. If empty, the metadata is not set.
+	AckResultErrorMetadataKey string
+
+	// NackDelay, if set, makes `Subscriber` hold a message nacked by the handler for the returned delay
+	// before nacking it in Pub/Sub, so it's not redelivered right away.
+	// Held messages count towards ReceiveSettings.MaxOutstandingMessages.
+	// The message is nacked immediately if the subscriber is closing or draining, or the context is canceled.
+	NackDelay NackDelayFn
+
+	// DefaultAckExtension, if set, defines how long `Subscriber` keeps a message leased if the handler does not extend it
+	// with ExtendAckDeadline or AckDeadlineHeartbeat. When the lease expires, the message is nacked.
+	// With ReceiveModeStreamingPull, it must not be greater than ReceiveSettings.MaxExtension,
+	// which is the limit for ExtendAckDeadline in this mode.
+	// By default, a message is nacked by `Subscriber` only if the handler extended its deadline and the deadline expired.
+	// Otherwise, the ack deadline is extended up to ReceiveSettings.MaxExtension, and then the message may be redelivered.
+	DefaultAckExtension time.Duration
+
+	// ReceiveBackoff returns the policy of retrying to receive messages after receiving failed.
+	// When it stops retrying, the output channel is closed and OnReceiveError is called.
+	// By default, DefaultReceiveBackoff is used, which never stops retrying.
+	ReceiveBackoff ReceiveBackoffFn
+	// PermanentReceiveError classifies the errors of receiving messages. Permanent errors are not retried:
+	// the output channel is closed and OnReceiveError is called.
+	// By default, IsPermanentReceiveError is used.
+	PermanentReceiveError PermanentReceiveErrorFn
+	// If true, `Subscriber` recreates a subscription that was deleted or expired while receiving messages from it,
+	// with the same config, and resumes receiving. Messages that were not acked are lost with the deleted subscription.
+	// Otherwise, the subscription not being found is a permanent error by default.
+	// It has no effect if DoNotCreateSubscriptionIfMissing is true.
+	RecreateDeletedSubscription bool
+	// OnReceiveError is called when `Subscriber` stops receiving messages of a topic because of an error,
+	// before the output channel is closed. The error is logged regardless of this callback.
+	OnReceiveError ReceiveErrorFn
+
+	// Tracing, if set, enables OpenTelemetry tracing of received messages.
+	// The trace context is extracted from the message attributes, and the process span is set in msg.Context().
+	Tracing *TracingConfig
+	// Metrics receives the measurements of received messages and of receiving restarts.
+	// By default, NoopMetrics is used. Use NewOpenTelemetryMetrics to record them with OpenTelemetry.
+	Metrics Metrics
 }
 
+// AckResultErrorFn is called when an ack or nack of a message was not successful with exactly-once delivery enabled.
+// acked is true if the message was acked, false if it was nacked.
+type AckResultErrorFn func(msg *message.Message, acked bool, err error)
+
 func (sc SubscriberConfig) topicProjectID() string {
 	if sc.TopicProjectID != "" {
 		return sc.TopicProjectID
@@ -106,6 +227,14 @@ func (sc SubscriberConfig) topicProjectID() string {
 	return sc.ProjectID
 }
 
+func (sc SubscriberConfig) topicProvisioner(logger watermill.LoggerAdapter) topicProvisioner {
+	return topicProvisioner{
+		doNotCreateTopicIfMissing: sc.DoNotCreateTopicIfMissing,
+		topicConfigFn:             sc.TopicConfigFn,
+		logger:                    logger,
+	}
+}
+
 type SubscriptionNameFn func(topic string) string
 
 // TopicSubscriptionName uses the topic name as the subscription name.
@@ -124,12 +253,72 @@ func (c *SubscriberConfig) setDefaults() {
 	if c.GenerateSubscriptionName == nil {
 		c.GenerateSubscriptionName = TopicSubscriptionName
 	}
+	if c.ProjectID == "" && c.Client != nil {
+		c.ProjectID = c.Client.Project()
+	}
 	if c.InitializeTimeout == 0 {
 		c.InitializeTimeout = time.Second * 10
 	}
 	if c.Unmarshaler == nil {
 		c.Unmarshaler = DefaultMarshalerUnmarshaler{}
 	}
+	if c.TopicConfigFn == nil {
+		c.TopicConfigFn = staticTopicConfig(c.TopicConfig)
+	}
+	if c.AckResultTimeout == 0 {
+		c.AckResultTimeout = time.Second * 30
+	}
+	c.SynchronousPullSettings.setDefaults()
+	if c.ReceiveBackoff == nil {
+		c.ReceiveBackoff = DefaultReceiveBackoff
+	}
+	if c.PermanentReceiveError == nil {
+		c.PermanentReceiveError = IsPermanentReceiveError
+	}
+	if c.DeadLetter != nil {
+		deadLetter := *c.DeadLetter
+		deadLetter.setDefaults()
+		c.DeadLetter = &deadLetter
+	}
+	if c.Metrics == nil {
+		c.Metrics = NoopMetrics{}
+	}
+	if c.Tracing != nil {
+		tracing := *c.Tracing
+		tracing.setDefaults()
+		c.Tracing = &tracing
+	}
+}
+
+func (c SubscriberConfig) validate() error {
+	if c.Client != nil && c.ClientPool != nil {
+		return errors.New("only one of Client and ClientPool may be set")
+	}
+	if maxExtension := c.maxAckExtension(); c.ReceiveMode == ReceiveModeStreamingPull && maxExtension > 0 && c.DefaultAckExtension > maxExtension {
+		return errors.Errorf(
+			"DefaultAckExtension (%s) must not be greater than ReceiveSettings.MaxExtension (%s)",
+			c.DefaultAckExtension,
+			maxExtension,
+		)
+	}
+	if c.ReceiveMode == ReceiveModeSynchronousPull {
+		if err := c.SynchronousPullSettings.validate(); err != nil {
+			return err
+		}
+		if c.Client != nil && len(c.SynchronousPullSettings.ClientOptions) == 0 {
+			return errors.New("SynchronousPullSettings.ClientOptions must be set to use ReceiveModeSynchronousPull with Client")
+		}
+	}
+	if err := c.StartFrom.validate(); err != nil {
+		return err
+	}
+	if c.DeadLetter != nil {
+		if err := c.DeadLetter.validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func NewSubscriber(
@@ -137,6 +326,9 @@ func NewSubscriber(
 	logger watermill.LoggerAdapter,
 ) (*Subscriber, error) {
 	config.setDefaults()
+	if err := config.validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid config")
+	}
 
 	if logger == nil {
 		logger = watermill.NopLogger{}
@@ -148,7 +340,10 @@ func NewSubscriber(
 		closedLock: sync.Mutex{},
 
 		allSubscriptionsWaitGroup: sync.WaitGroup{},
-		activeSubscriptions:       map[string]*pubsub.Subscription{},
+		inFlight:                  newInFlightMessages(),
+		health:                    newSubscriptionsHealth(),
+		activeSubscriptions:       map[string]*activeSubscription{},
+		startedFrom:               map[string]struct{}{},
 		activeSubscriptionsLock:   sync.RWMutex{},
 
 		config: config,
@@ -167,6 +362,10 @@ func NewSubscriber(
 //
 // Be aware that in Google Cloud Pub/Sub, only messages sent after the subscription was created can be consumed.
 //
+// Subscribe may be called multiple times for the same subscription, also concurrently.
+// Each returned channel receives from its own stream, and Pub/Sub distributes the messages between the channels.
+// A message is acked or nacked on the stream it was received from.
+//
 // See https://cloud.google.com/pubsub/docs/subscriber to find out more about how Google Cloud Pub/Sub Subscriptions work.
 func (s *Subscriber) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
 	if s.getClosed() {
@@ -185,54 +384,128 @@ func (s *Subscriber) Subscribe(ctx context.Context, topic string) (<-chan *messa
 
 	output := make(chan *message.Message)
 
-	sub, err := s.subscription(ctx, subscriptionName, topic)
-	if err != nil {
+	consumer := &subscriptionConsumer{
+		topic:            topic,
+		subscriptionName: subscriptionName,
+		cancel:           cancel,
+		tornDown:         make(chan struct{}),
+	}
+	if _, err := s.activeSubscription(ctx, subscriptionName, topic, consumer); err != nil {
 		cancel()
 		return nil, err
 	}
 
+	tracer := newSubscriptionTracer(s.config.Tracing, topic, subscriptionName)
+	metrics := subscriptionMetrics{
+		metrics:          s.config.Metrics,
+		topic:            topic,
+		subscriptionName: subscriptionName,
+	}
+
+	// Receiving stops when the `Subscriber` starts draining, but the messages in flight are processed until ctx is done.
+	receiveCtx, cancelReceive := context.WithCancel(ctx)
+
+	// consumer.sub changes if the subscription is recreated.
+	receive := func() error {
+		return s.receive(receiveCtx, ctx, consumer.sub, tracer, metrics, logFields, output)
+	}
+	if s.config.ReceiveMode == ReceiveModeSynchronousPull {
+		apiClient, err := s.subscriberAPIClient(ctx)
+		if err != nil {
+			cancelReceive()
+			cancel()
+			if releaseErr := s.releaseSubscription(subscriptionName, consumer); releaseErr != nil {
+				s.logger.Error("Could not release subscription", releaseErr, logFields)
+			}
+			return nil, err
+		}
+		receive = func() error {
+			return s.pull(receiveCtx, ctx, apiClient, consumer.sub, tracer, metrics, logFields, output)
+		}
+	}
+
+	s.health.started(consumer)
+
 	receiveFinished := make(chan struct{})
 	s.allSubscriptionsWaitGroup.Add(1)
 	go func() {
-		exponentialBackoff := backoff.NewExponentialBackOff()
-		exponentialBackoff.MaxElapsedTime = 0 // 0 means it never expires
-
-		if err := backoff.Retry(func() error {
-			err := s.receive(ctx, sub, logFields, output)
-			if err == nil {
-				s.logger.Info("Receiving messages finished with no error", logFields)
-				return nil
-			}
-
-			if s.getClosed() {
-				s.logger.Info("Receiving messages failed while closed", logFields)
-				return backoff.Permanent(err)
+		err := s.receiveWithRetry(receiveCtx, consumer, receive, logFields)
+		if err != nil && receiveCtx.Err() == nil && !s.getClosed() {
+			s.logger.Error("Receiving messages stopped", err, logFields)
+			if s.config.OnReceiveError != nil {
+				s.config.OnReceiveError(topic, err)
 			}
-
-			s.logger.Error("Receiving messages failed, retrying", err, logFields)
-			return err
-		}, exponentialBackoff); err != nil {
-			s.logger.Error("Retrying receiving messages failed", err, logFields)
+		} else {
+			err = nil
 		}
+		s.health.stopped(consumer, err)
 
 		close(receiveFinished)
 	}()
 
 	go func() {
-		<-s.closing
-		s.logger.Debug("Closing message consumer", logFields)
+		select {
+		case <-s.closing:
+			s.logger.Debug("Closing message consumer", logFields)
+		case <-ctx.Done():
+		}
 		cancel()
 	}()
 
+	go func() {
+		select {
+		case <-s.inFlight.Draining():
+			s.logger.Debug("Draining, no more messages are received", logFields)
+		case <-receiveCtx.Done():
+		}
+		cancelReceive()
+	}()
+
 	go func() {
 		<-receiveFinished
 		close(output)
+
+		if err := s.releaseSubscription(subscriptionName, consumer); err != nil {
+			s.logger.Error("Could not release subscription", err, logFields)
+		}
+		s.logger.Debug("Subscription torn down", logFields)
+
+		close(consumer.tornDown)
 		s.allSubscriptionsWaitGroup.Done()
 	}()
 
 	return output, nil
 }
 
+// Unsubscribe stops all subscriptions to the topic made with Subscribe, without closing the whole `Subscriber`.
+// It's an alternative to canceling the context passed to Subscribe.
+//
+// Unsubscribe blocks until the subscriptions are torn down: their output channels are closed,
+// and the client used by the subscription is closed.
+// A later Subscribe to the topic starts fresh, with a new client.
+func (s *Subscriber) Unsubscribe(topic string) error {
+	subscriptionName := s.config.GenerateSubscriptionName(topic)
+
+	s.activeSubscriptionsLock.RLock()
+	var consumers []*subscriptionConsumer
+	if active, ok := s.activeSubscriptions[subscriptionName]; ok {
+		for consumer := range active.consumers {
+			consumers = append(consumers, consumer)
+		}
+	}
+	s.activeSubscriptionsLock.RUnlock()
+
+	for _, consumer := range consumers {
+		consumer.cancel()
+	}
+	for _, consumer := range consumers {
+		<-consumer.tornDown
+	}
+
+	// The subscription may be still cached if it was used without Subscribe, for example by SubscribeInitialize.
+	return s.releaseSubscription(subscriptionName, nil)
+}
+
 func (s *Subscriber) SubscribeInitialize(topic string) (err error) {
 	ctx, cancel := context.WithTimeout(context.Background(), s.config.InitializeTimeout)
 	defer cancel()
@@ -253,7 +526,8 @@ func (s *Subscriber) SubscribeInitialize(topic string) (err error) {
 }
 
 // Close notifies the Subscriber to stop processing messages on all subscriptions, close all the output channels
-// and terminate the connection.
+// and terminate the connection. Messages that are not acked or nacked yet are nacked.
+// Use CloseWithContext to let them finish first.
 func (s *Subscriber) Close() error {
 	if s.getClosed() {
 		return nil
@@ -273,6 +547,12 @@ func (s *Subscriber) Close() error {
 			err = multierror.Append(err, errors.Wrap(closeErr, "unable to close client"))
 		}
 	}
+	if s.apiClient != nil {
+		closeErr := s.apiClient.Close()
+		if closeErr != nil {
+			err = multierror.Append(err, errors.Wrap(closeErr, "unable to close subscriber API client"))
+		}
+	}
 	if err != nil {
 		return err
 	}
@@ -282,99 +562,428 @@ func (s *Subscriber) Close() error {
 	return nil
 }
 
+// receive receives messages until receiveCtx is canceled. The received messages are processed with ctx,
+// so they are not nacked when receiveCtx is canceled because the `Subscriber` is draining.
 func (s *Subscriber) receive(
+	receiveCtx context.Context,
 	ctx context.Context,
 	sub *pubsub.Subscription,
+	tracer *subscriptionTracer,
+	metrics subscriptionMetrics,
 	subcribeLogFields watermill.LogFields,
 	output chan *message.Message,
 ) error {
-	return sub.Receive(ctx, func(ctx context.Context, pubsubMsg *pubsub.Message) {
-		logFields := subcribeLogFields.Copy()
+	return sub.Receive(receiveCtx, func(callbackCtx context.Context, pubsubMsg *pubsub.Message) {
+		// The values of the callback context are kept, but it's canceled only with ctx.
+		msgCtx, cancel := context.WithCancel(context.WithoutCancel(callbackCtx))
+		defer cancel()
+		stop := context.AfterFunc(ctx, cancel)
+		defer stop()
+
+		received := streamingMessage{s: s, pubsubMsg: pubsubMsg, msgLease: s.newStreamingMessageLease()}
+		s.processMessage(msgCtx, pubsubMsg, received, tracer, metrics, subcribeLogFields, output)
+	})
+}
 
-		msg, err := s.config.Unmarshaler.Unmarshal(pubsubMsg)
-		if err != nil {
-			s.logger.Error("Could not unmarshal Google Cloud PubSub message", err, logFields)
-			pubsubMsg.Nack()
-			return
-		}
-		logFields["message_uuid"] = msg.UUID
+// receivedMessage acks and nacks a message received in one of the receive modes.
+type receivedMessage interface {
+	ack(ctx context.Context, msg *message.Message, logFields watermill.LogFields)
+	nack(ctx context.Context, msg *message.Message, logFields watermill.LogFields)
+	// nackUnconsumed nacks a message that was not sent to the output channel.
+	nackUnconsumed()
+	// lease returns the lease of the message, or nil if its ack deadline is not extended.
+	lease() *messageLease
+}
 
-		ctx, cancelCtx := context.WithCancel(ctx)
-		msg.SetContext(ctx)
-		defer cancelCtx()
+type streamingMessage struct {
+	s         *Subscriber
+	pubsubMsg *pubsub.Message
+	msgLease  *messageLease
+}
 
-		select {
-		case <-s.closing:
-			s.logger.Info(
-				"Message not consumed, subscriber is closing",
-				logFields,
-			)
-			pubsubMsg.Nack()
-			return
-		case <-ctx.Done():
-			s.logger.Info(
-				"Message not consumed, ctx canceled",
-				logFields,
-			)
-			pubsubMsg.Nack()
-			return
-		case output <- msg:
-			// message consumed, wait for ack (or nack)
-		}
+func (m streamingMessage) ack(ctx context.Context, msg *message.Message, logFields watermill.LogFields) {
+	m.s.ack(ctx, m.pubsubMsg, msg, logFields)
+}
 
-		select {
-		case <-s.closing:
-			pubsubMsg.Nack()
-			s.logger.Trace(
-				"Closing, nacking message",
-				logFields,
-			)
-		case <-ctx.Done():
-			pubsubMsg.Nack()
-			s.logger.Trace(
-				"Ctx done, nacking message",
-				logFields,
-			)
-		case <-msg.Acked():
-			s.logger.Trace(
-				"Msg acked",
-				logFields,
-			)
-			pubsubMsg.Ack()
-		case <-msg.Nacked():
-			pubsubMsg.Nack()
-			s.logger.Trace(
-				"Msg nacked",
-				logFields,
-			)
-		}
+func (m streamingMessage) nack(ctx context.Context, msg *message.Message, logFields watermill.LogFields) {
+	m.s.nack(ctx, m.pubsubMsg, msg, logFields)
+}
+
+func (m streamingMessage) nackUnconsumed() {
+	m.pubsubMsg.Nack()
+}
+
+func (m streamingMessage) lease() *messageLease {
+	return m.msgLease
+}
+
+// processMessage sends the message to the output channel and waits until it's acked or nacked.
+func (s *Subscriber) processMessage(
+	ctx context.Context,
+	pubsubMsg *pubsub.Message,
+	received receivedMessage,
+	tracer *subscriptionTracer,
+	metrics subscriptionMetrics,
+	subcribeLogFields watermill.LogFields,
+	output chan *message.Message,
+) {
+	logFields := subcribeLogFields.Copy()
+
+	reportAckResult := metrics.received(ctx, pubsubMsg)
+	acked := false
+	defer func() {
+		reportAckResult(acked)
+	}()
+
+	ctx, spans := tracer.start(ctx, pubsubMsg)
+
+	msg, err := s.config.Unmarshaler.Unmarshal(pubsubMsg)
+	if err != nil {
+		s.logger.Error("Could not unmarshal Google Cloud PubSub message", err, logFields)
+		spans.nacked("could not unmarshal message")
+		received.nackUnconsumed()
+		return
+	}
+	logFields["message_uuid"] = msg.UUID
+
+	ctx, cancelCtx := context.WithCancel(ctx)
+	defer cancelCtx()
+
+	lease := received.lease()
+	defer lease.stop()
+	if lease != nil {
+		ctx = context.WithValue(ctx, messageLeaseKey{}, lease)
+	}
+	msg.SetContext(ctx)
+
+	if s.inFlight.isDraining() {
+		s.logger.Info(
+			"Message not consumed, subscriber is draining",
+			logFields,
+		)
+		spans.nacked("message not consumed")
+		received.nackUnconsumed()
+		return
+	}
+
+	s.inFlight.sending()
+	select {
+	case <-s.closing:
+		s.inFlight.notSent()
+		s.logger.Info(
+			"Message not consumed, subscriber is closing",
+			logFields,
+		)
+		spans.nacked("message not consumed")
+		received.nackUnconsumed()
+		return
+	case <-s.inFlight.Draining():
+		s.inFlight.notSent()
+		s.logger.Info(
+			"Message not consumed, subscriber is draining",
+			logFields,
+		)
+		spans.nacked("message not consumed")
+		received.nackUnconsumed()
+		return
+	case <-ctx.Done():
+		s.inFlight.notSent()
+		s.logger.Info(
+			"Message not consumed, ctx canceled",
+			logFields,
+		)
+		spans.nacked("message not consumed")
+		received.nackUnconsumed()
+		return
+	case output <- msg:
+		// message consumed, wait for ack (or nack)
+	}
+
+	spans.delivered()
+	handled := false
+	defer func() {
+		s.inFlight.done(handled)
+	}()
+
+	select {
+	case <-s.closing:
+		s.logger.Trace(
+			"Closing, nacking message",
+			logFields,
+		)
+		spans.nacked("subscriber closed")
+		received.nack(ctx, msg, logFields)
+	case <-ctx.Done():
+		s.logger.Trace(
+			"Ctx done, nacking message",
+			logFields,
+		)
+		spans.nacked("ctx done")
+		received.nack(ctx, msg, logFields)
+	case <-lease.Expired():
+		s.logger.Info(
+			"Ack deadline of message expired, nacking message",
+			logFields,
+		)
+		spans.nacked("ack deadline expired")
+		received.nack(ctx, msg, logFields)
+	case <-msg.Acked():
+		s.logger.Trace(
+			"Msg acked",
+			logFields,
+		)
+		handled = true
+		acked = true
+		spans.acked()
+		received.ack(ctx, msg, logFields)
+	case <-msg.Nacked():
+		s.logger.Trace(
+			"Msg nacked",
+			logFields,
+		)
+		handled = true
+		spans.nacked("message nacked")
+		s.holdNackedMessage(ctx, pubsubMsg, msg, logFields)
+		received.nack(ctx, msg, logFields)
+	}
+}
+
+func (s *Subscriber) ack(ctx context.Context, pubsubMsg *pubsub.Message, msg *message.Message, logFields watermill.LogFields) {
+	if !s.config.SubscriptionConfig.EnableExactlyOnceDelivery {
+		pubsubMsg.Ack()
+		return
+	}
+
+	s.waitForAckResult(ctx, pubsubMsg.AckWithResult(), msg, true, logFields)
+}
+
+func (s *Subscriber) nack(ctx context.Context, pubsubMsg *pubsub.Message, msg *message.Message, logFields watermill.LogFields) {
+	if !s.config.SubscriptionConfig.EnableExactlyOnceDelivery {
+		pubsubMsg.Nack()
+		return
+	}
+
+	s.waitForAckResult(ctx, pubsubMsg.NackWithResult(), msg, false, logFields)
+}
+
+// waitForAckResult waits until the server confirms the ack or nack.
+// With exactly-once delivery, a message whose ack failed is going to be redelivered.
+func (s *Subscriber) waitForAckResult(
+	ctx context.Context,
+	result *pubsub.AckResult,
+	msg *message.Message,
+	acked bool,
+	logFields watermill.LogFields,
+) {
+	// The message may be nacked because ctx is done, but the result should still be awaited.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.config.AckResultTimeout)
+	defer cancel()
+
+	status, err := result.Get(ctx)
+	if err == nil {
+		return
+	}
+
+	logFields = logFields.Add(watermill.LogFields{
+		"acked":      acked,
+		"ack_status": ackStatusString(status),
 	})
+	s.ackFailed(msg, acked, err, logFields)
+}
+
+// ackFailed reports that the ack or nack of the message was not successful.
+func (s *Subscriber) ackFailed(msg *message.Message, acked bool, err error, logFields watermill.LogFields) {
+	s.logger.Error("Acknowledging message failed", err, logFields)
+
+	if s.config.AckResultErrorMetadataKey != "" {
+		msg.Metadata.Set(s.config.AckResultErrorMetadataKey, err.Error())
+	}
+	if s.config.OnAckResultError != nil {
+		s.config.OnAckResultError(msg, acked, err)
+	}
+}
+
+func ackStatusString(status pubsub.AcknowledgeStatus) string {
+	switch status {
+	case pubsub.AcknowledgeStatusSuccess:
+		return "success"
+	case pubsub.AcknowledgeStatusPermissionDenied:
+		return "permission_denied"
+	case pubsub.AcknowledgeStatusFailedPrecondition:
+		return "failed_precondition"
+	case pubsub.AcknowledgeStatusInvalidAckID:
+		return "invalid_ack_id"
+	default:
+		return "other"
+	}
+}
+
+// activeSubscription is a subscription used by the `Subscriber`, together with the client it was created with.
+type activeSubscription struct {
+	sub    *pubsub.Subscription
+	client *pubsub.Client
+
+	// consumers are the Subscribe calls receiving messages from the subscription.
+	consumers map[*subscriptionConsumer]struct{}
+}
+
+// newHandle returns a new handle of the subscription.
+// The client library allows only one Receive call on a handle at a time,
+// so each Subscribe call receives with its own handle, and Pub/Sub distributes the messages between them.
+func (a *activeSubscription) newHandle() *pubsub.Subscription {
+	sub := a.client.Subscription(a.sub.ID())
+	sub.ReceiveSettings = a.sub.ReceiveSettings
+
+	return sub
+}
+
+// subscriptionConsumer is a single Subscribe call.
+type subscriptionConsumer struct {
+	topic            string
+	subscriptionName string
+
+	// active is the subscription the consumer is registered in, and sub is the handle it receives with.
+	// They are set when the consumer is registered, and used only by the goroutine receiving messages.
+	active *activeSubscription
+	sub    *pubsub.Subscription
+
+	cancel context.CancelFunc
+	// tornDown is closed once the output channel and the clients used by the consumer are closed.
+	tornDown chan struct{}
 }
 
 // subscription obtains a subscription object.
 // If subscription doesn't exist on PubSub, create it, unless config variable DoNotCreateSubscriptionWhenMissing is set.
-func (s *Subscriber) subscription(ctx context.Context, subscriptionName, topicName string) (sub *pubsub.Subscription, err error) {
-	s.activeSubscriptionsLock.RLock()
-	sub, ok := s.activeSubscriptions[subscriptionName]
-	s.activeSubscriptionsLock.RUnlock()
-	if ok {
-		return sub, nil
+func (s *Subscriber) subscription(ctx context.Context, subscriptionName, topicName string) (*pubsub.Subscription, error) {
+	active, err := s.activeSubscription(ctx, subscriptionName, topicName, nil)
+	if err != nil {
+		return nil, err
 	}
 
+	return active.sub, nil
+}
+
+// activeSubscription returns the cached subscription, or creates a client and provisions the subscription.
+// If consumer is not nil, it's registered within the same lock, so the subscription is not released in the meantime.
+func (s *Subscriber) activeSubscription(
+	ctx context.Context,
+	subscriptionName, topicName string,
+	consumer *subscriptionConsumer,
+) (*activeSubscription, error) {
 	s.activeSubscriptionsLock.Lock()
 	defer s.activeSubscriptionsLock.Unlock()
-	defer func() {
-		if err == nil {
-			s.activeSubscriptions[subscriptionName] = sub
+
+	active, ok := s.activeSubscriptions[subscriptionName]
+	if !ok {
+		var err error
+		active, err = s.newActiveSubscription(ctx, subscriptionName, topicName)
+		if err != nil {
+			return nil, err
 		}
-	}()
+	}
 
+	if consumer != nil {
+		active.consumers[consumer] = struct{}{}
+		consumer.active = active
+		consumer.sub = active.newHandle()
+	}
+
+	return active, nil
+}
+
+// newActiveSubscription creates a client, provisions the subscription and caches it.
+// activeSubscriptionsLock must be held.
+func (s *Subscriber) newActiveSubscription(ctx context.Context, subscriptionName, topicName string) (*activeSubscription, error) {
 	client, err := s.newClient(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	sub = client.Subscription(subscriptionName)
+	sub, err := s.provisionSubscription(ctx, client, subscriptionName, topicName)
+	_, startedFrom := s.startedFrom[subscriptionName]
+	if err == nil && !startedFrom {
+		err = s.startFrom(ctx, client, sub, topicName, subscriptionName)
+	}
+	if err != nil {
+		if closeErr := s.closeClient(client); closeErr != nil {
+			s.logger.Error("Could not close client", closeErr, nil)
+		}
+		return nil, err
+	}
+
+	s.startedFrom[subscriptionName] = struct{}{}
+
+	active := &activeSubscription{
+		sub:       sub,
+		client:    client,
+		consumers: map[*subscriptionConsumer]struct{}{},
+	}
+	s.activeSubscriptions[subscriptionName] = active
+
+	return active, nil
+}
+
+// reprovisionSubscription evicts the cached subscription of the consumer and provisions it again with the same config,
+// so a subscription that was deleted or expired is created again. The consumer is moved to the new subscription.
+// If the subscription was already provisioned again by another consumer, the consumer is moved to it.
+func (s *Subscriber) reprovisionSubscription(ctx context.Context, consumer *subscriptionConsumer) error {
+	s.activeSubscriptionsLock.Lock()
+
+	old := consumer.active
+	active, ok := s.activeSubscriptions[consumer.subscriptionName]
+	if !ok || active == old {
+		var err error
+		active, err = s.newActiveSubscription(ctx, consumer.subscriptionName, consumer.topic)
+		if err != nil {
+			// The consumer stays registered in the old subscription, so it can be released.
+			s.activeSubscriptionsLock.Unlock()
+			return err
+		}
+	}
+
+	delete(old.consumers, consumer)
+	closeOld := len(old.consumers) == 0
+
+	active.consumers[consumer] = struct{}{}
+	consumer.active = active
+	consumer.sub = active.newHandle()
+
+	s.activeSubscriptionsLock.Unlock()
+
+	if closeOld {
+		return s.closeClient(old.client)
+	}
+
+	return nil
+}
+
+// releaseSubscription unregisters the consumer from its subscription, if consumer is not nil.
+// Otherwise, the cached subscription is released.
+// If the subscription has no consumers left, it's removed from the cache and its client is closed.
+func (s *Subscriber) releaseSubscription(subscriptionName string, consumer *subscriptionConsumer) error {
+	s.activeSubscriptionsLock.Lock()
+	active, ok := s.activeSubscriptions[subscriptionName]
+	if consumer != nil {
+		// The consumer may be registered in a subscription that was already provisioned again.
+		active, ok = consumer.active, true
+		delete(active.consumers, consumer)
+	}
+	if !ok || len(active.consumers) > 0 {
+		s.activeSubscriptionsLock.Unlock()
+		return nil
+	}
+	if s.activeSubscriptions[subscriptionName] == active {
+		delete(s.activeSubscriptions, subscriptionName)
+	}
+	s.activeSubscriptionsLock.Unlock()
+
+	return s.closeClient(active.client)
+}
+
+// provisionSubscription returns the existing subscription with its config reconciled,
+// or creates it if it doesn't exist.
+func (s *Subscriber) provisionSubscription(ctx context.Context, client *pubsub.Client, subscriptionName, topicName string) (*pubsub.Subscription, error) {
+	sub := client.Subscription(subscriptionName)
 	exists, err := sub.Exists(ctx)
 	if err != nil {
 		return nil, errors.Wrapf(err, "could not check if subscription %s exists", subscriptionName)
@@ -399,28 +1008,15 @@ func (s *Subscriber) subscription(ctx context.Context, subscriptionName, topicNa
 }
 
 func (s *Subscriber) createSubscription(ctx context.Context, client *pubsub.Client, topicName, subscriptionName string) (*pubsub.Subscription, error) {
-	t := client.Topic(topicName)
-	exists, err := t.Exists(ctx)
+	t, err := s.config.topicProvisioner(s.logger).topic(ctx, client, topicName)
 	if err != nil {
-		return nil, errors.Wrapf(err, "could not check if topic %s exists", topicName)
-	}
-
-	if !exists && s.config.DoNotCreateTopicIfMissing {
-		return nil, errors.Wrap(ErrTopicDoesNotExist, topicName)
+		return nil, err
 	}
 
-	if !exists {
-		t, err = client.CreateTopic(ctx, topicName)
-
-		if status.Code(err) == codes.AlreadyExists {
-			s.logger.Debug("Topic already exists", watermill.LogFields{"topic": topicName})
-			t = client.Topic(topicName)
-		} else if err != nil {
-			return nil, errors.Wrap(err, "could not create topic for subscription")
-		}
+	config, err := s.expectedSubscriptionConfig(ctx, client, topicName)
+	if err != nil {
+		return nil, err
 	}
-
-	config := s.config.SubscriptionConfig
 	config.Topic = t
 
 	sub, err := client.CreateSubscription(ctx, subscriptionName, config)
@@ -433,7 +1029,31 @@ func (s *Subscriber) createSubscription(ctx context.Context, client *pubsub.Clie
 	return sub, nil
 }
 
+// expectedSubscriptionConfig returns SubscriptionConfig completed with the resources provisioned by `Subscriber`.
+func (s *Subscriber) expectedSubscriptionConfig(ctx context.Context, client *pubsub.Client, topicName string) (pubsub.SubscriptionConfig, error) {
+	config := s.config.SubscriptionConfig
+
+	if s.config.DeadLetter != nil {
+		deadLetterPolicy, err := s.deadLetterPolicy(ctx, client, topicName)
+		if err != nil {
+			return pubsub.SubscriptionConfig{}, err
+		}
+		config.DeadLetterPolicy = deadLetterPolicy
+	}
+
+	return config, nil
+}
+
+// newClient returns the client used for a subscription or for operations not bound to a subscription.
+// Only the clients created by `Subscriber` are tracked in clients, and closed by it.
 func (s *Subscriber) newClient(ctx context.Context) (*pubsub.Client, error) {
+	if s.config.Client != nil {
+		return s.config.Client, nil
+	}
+	if s.config.ClientPool != nil {
+		return s.config.ClientPool.Client(ctx, s.config.ProjectID)
+	}
+
 	client, err := pubsub.NewClient(ctx, s.config.ProjectID, s.config.ClientOptions...)
 	if err != nil {
 		return nil, err
@@ -446,6 +1066,31 @@ func (s *Subscriber) newClient(ctx context.Context) (*pubsub.Client, error) {
 	return client, nil
 }
 
+// closeClient closes the client before the `Subscriber` is closed.
+// Clients not created by `Subscriber` are left open.
+func (s *Subscriber) closeClient(client *pubsub.Client) error {
+	owned := false
+	s.clientsLock.Lock()
+	for i, c := range s.clients {
+		if c == client {
+			s.clients = append(s.clients[:i], s.clients[i+1:]...)
+			owned = true
+			break
+		}
+	}
+	s.clientsLock.Unlock()
+
+	if !owned {
+		return nil
+	}
+
+	if err := client.Close(); err != nil {
+		return errors.Wrap(err, "unable to close client")
+	}
+
+	return nil
+}
+
 func (s *Subscriber) isFilterChanged(config pubsub.SubscriptionConfig) bool {
 	oldFilter := strings.ReplaceAll(config.Filter, " ", "")
 	newFilter := strings.ReplaceAll(s.config.SubscriptionConfig.Filter, " ", "")
@@ -473,47 +1118,12 @@ func (s *Subscriber) existingSubscription(ctx context.Context, client *pubsub.Cl
 
 	sub.ReceiveSettings = s.config.ReceiveSettings
 
-	if s.isFilterChanged(config) && s.config.RecreateSubscriptionIfFilterChanged {
-		s.logger.Debug("filter changed", watermill.LogFields{
-			"subscription_name": sub.String(),
-			"old_filter":        config.Filter,
-			"new_filter":        s.config.SubscriptionConfig.Filter,
-		})
-		if err := sub.Delete(ctx); err != nil {
-			return nil, errors.Wrap(err, "could not delete subscription")
-		}
-		s.logger.Debug("Deleted subscription", watermill.LogFields{
-			"subscription_name": sub.String(),
-		})
-		return s.createSubscription(ctx, client, topicName, subscriptionName)
-	}
-
-	if s.config.DoNotUpdateSubscriptionIfEndpointChanged {
-		return sub, nil
+	expectedConfig, err := s.expectedSubscriptionConfig(ctx, client, topicName)
+	if err != nil {
+		return nil, err
 	}
 
-	if s.isPushEndpointChanged(config) {
-		updatedConfig, err := sub.Update(ctx, pubsub.SubscriptionConfigToUpdate{
-			PushConfig: &s.config.SubscriptionConfig.PushConfig,
-		})
-		if err != nil {
-			return nil, errors.Wrap(err, "could not update subscription")
-		}
-		logFields := watermill.LogFields{
-			"provider":          ProviderName,
-			"topic":             topicName,
-			"subscription_name": sub.String(),
-			"old_endpoint":      config.PushConfig.Endpoint,
-			"new_endpoint":      updatedConfig.PushConfig.Endpoint,
-		}
-		s.logger.Info("Updated subscription endpoint", logFields)
-
-		s.logger.Debug("Updated subscription config", watermill.LogFields{
-			"old_config": config,
-			"new_config": updatedConfig,
-		})
-	}
-	return sub, nil
+	return s.reconcileSubscriptionConfig(ctx, client, sub, expectedConfig, config, topicName, subscriptionName)
 }
 
 func (s *Subscriber) setClosed(value bool) {
@@ -0,0 +1,398 @@
+package googlecloud
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/pkg/errors"
+
+	"github.com/ThreeDotsLabs/watermill"
+)
+
+// ErrSubscriptionConfigDrift happens when the config of an existing subscription differs from the expected config
+// in a field with SubscriptionConfigDriftFail policy.
+var ErrSubscriptionConfigDrift = errors.New("existing subscription config differs from the expected config")
+
+// SubscriptionConfigField identifies a field of pubsub.SubscriptionConfig that the Subscriber compares
+// with the config of an existing subscription.
+type SubscriptionConfigField string
+
+const (
+	SubscriptionConfigFieldFilter                    SubscriptionConfigField = "filter"
+	SubscriptionConfigFieldPushEndpoint              SubscriptionConfigField = "push_endpoint"
+	SubscriptionConfigFieldAckDeadline               SubscriptionConfigField = "ack_deadline"
+	SubscriptionConfigFieldRetainAckedMessages       SubscriptionConfigField = "retain_acked_messages"
+	SubscriptionConfigFieldRetentionDuration         SubscriptionConfigField = "retention_duration"
+	SubscriptionConfigFieldExpirationPolicy          SubscriptionConfigField = "expiration_policy"
+	SubscriptionConfigFieldDeadLetterPolicy          SubscriptionConfigField = "dead_letter_policy"
+	SubscriptionConfigFieldRetryPolicy               SubscriptionConfigField = "retry_policy"
+	SubscriptionConfigFieldLabels                    SubscriptionConfigField = "labels"
+	SubscriptionConfigFieldEnableExactlyOnceDelivery SubscriptionConfigField = "enable_exactly_once_delivery"
+	SubscriptionConfigFieldEnableMessageOrdering     SubscriptionConfigField = "enable_message_ordering"
+)
+
+// immutableSubscriptionConfigFields can't be changed without recreating the subscription.
+var immutableSubscriptionConfigFields = map[SubscriptionConfigField]struct{}{
+	SubscriptionConfigFieldFilter:                {},
+	SubscriptionConfigFieldEnableMessageOrdering: {},
+}
+
+// SubscriptionConfigDriftPolicy defines what the Subscriber does when a field of an existing subscription's config
+// differs from SubscriberConfig.SubscriptionConfig.
+//
+// Every difference is logged, regardless of the policy.
+type SubscriptionConfigDriftPolicy int
+
+const (
+	// SubscriptionConfigDriftIgnore keeps the existing subscription as it is.
+	SubscriptionConfigDriftIgnore SubscriptionConfigDriftPolicy = iota
+	// SubscriptionConfigDriftUpdate updates the field of the existing subscription.
+	// It can't be used for the filter and message ordering, which can't be updated in place.
+	SubscriptionConfigDriftUpdate
+	// SubscriptionConfigDriftRecreate deletes the existing subscription and creates it with the expected config.
+	SubscriptionConfigDriftRecreate
+	// SubscriptionConfigDriftFail makes subscribing fail with ErrSubscriptionConfigDrift.
+	SubscriptionConfigDriftFail
+)
+
+func (p SubscriptionConfigDriftPolicy) String() string {
+	switch p {
+	case SubscriptionConfigDriftIgnore:
+		return "ignore"
+	case SubscriptionConfigDriftUpdate:
+		return "update"
+	case SubscriptionConfigDriftRecreate:
+		return "recreate"
+	case SubscriptionConfigDriftFail:
+		return "fail"
+	default:
+		return fmt.Sprintf("SubscriptionConfigDriftPolicy(%d)", int(p))
+	}
+}
+
+type subscriptionConfigDiff struct {
+	field    SubscriptionConfigField
+	oldValue interface{}
+	newValue interface{}
+	policy   SubscriptionConfigDriftPolicy
+}
+
+// driftPolicy returns the policy for the field.
+// Fields not present in SubscriptionConfigDriftPolicies are ignored,
+// except for the filter and the push endpoint, which follow RecreateSubscriptionIfFilterChanged
+// and DoNotUpdateSubscriptionIfEndpointChanged, and the dead-letter policy, which is updated if DeadLetter is set.
+func (sc SubscriberConfig) driftPolicy(field SubscriptionConfigField) SubscriptionConfigDriftPolicy {
+	if policy, ok := sc.SubscriptionConfigDriftPolicies[field]; ok {
+		return policy
+	}
+
+	switch field {
+	case SubscriptionConfigFieldFilter:
+		if sc.RecreateSubscriptionIfFilterChanged {
+			return SubscriptionConfigDriftRecreate
+		}
+	case SubscriptionConfigFieldPushEndpoint:
+		if !sc.DoNotUpdateSubscriptionIfEndpointChanged {
+			return SubscriptionConfigDriftUpdate
+		}
+	case SubscriptionConfigFieldDeadLetterPolicy:
+		if sc.DeadLetter != nil {
+			return SubscriptionConfigDriftUpdate
+		}
+	}
+
+	return SubscriptionConfigDriftIgnore
+}
+
+// subscriptionConfigDiffs compares the config of an existing subscription with the expected config.
+// Fields left empty in the expected config are not compared, as they mean the server default,
+// except for the filter, the push endpoint and the boolean flags.
+func (s *Subscriber) subscriptionConfigDiffs(expected, existing pubsub.SubscriptionConfig) []subscriptionConfigDiff {
+	var diffs []subscriptionConfigDiff
+	add := func(field SubscriptionConfigField, oldValue, newValue interface{}) {
+		diffs = append(diffs, subscriptionConfigDiff{
+			field:    field,
+			oldValue: oldValue,
+			newValue: newValue,
+			policy:   s.config.driftPolicy(field),
+		})
+	}
+
+	if s.isFilterChanged(existing) {
+		add(SubscriptionConfigFieldFilter, existing.Filter, expected.Filter)
+	}
+	if s.isPushEndpointChanged(existing) {
+		add(SubscriptionConfigFieldPushEndpoint, existing.PushConfig.Endpoint, expected.PushConfig.Endpoint)
+	}
+	if expected.AckDeadline != 0 && expected.AckDeadline != existing.AckDeadline {
+		add(SubscriptionConfigFieldAckDeadline, existing.AckDeadline, expected.AckDeadline)
+	}
+	if expected.RetainAckedMessages != existing.RetainAckedMessages {
+		add(SubscriptionConfigFieldRetainAckedMessages, existing.RetainAckedMessages, expected.RetainAckedMessages)
+	}
+	if expected.RetentionDuration != 0 && expected.RetentionDuration != existing.RetentionDuration {
+		add(SubscriptionConfigFieldRetentionDuration, existing.RetentionDuration, expected.RetentionDuration)
+	}
+	if expectedPolicy, ok := optionalDuration(expected.ExpirationPolicy); ok {
+		if existingPolicy, _ := optionalDuration(existing.ExpirationPolicy); expectedPolicy != existingPolicy {
+			add(SubscriptionConfigFieldExpirationPolicy, existingPolicy, expectedPolicy)
+		}
+	}
+	if expected.DeadLetterPolicy != nil && !reflect.DeepEqual(expected.DeadLetterPolicy, existing.DeadLetterPolicy) {
+		add(SubscriptionConfigFieldDeadLetterPolicy, existing.DeadLetterPolicy, expected.DeadLetterPolicy)
+	}
+	if expected.RetryPolicy != nil && !retryPolicyMatches(expected.RetryPolicy, existing.RetryPolicy) {
+		add(SubscriptionConfigFieldRetryPolicy, existing.RetryPolicy, expected.RetryPolicy)
+	}
+	if expected.Labels != nil && !labelsEqual(expected.Labels, existing.Labels) {
+		add(SubscriptionConfigFieldLabels, existing.Labels, expected.Labels)
+	}
+	if expected.EnableExactlyOnceDelivery != existing.EnableExactlyOnceDelivery {
+		add(SubscriptionConfigFieldEnableExactlyOnceDelivery, existing.EnableExactlyOnceDelivery, expected.EnableExactlyOnceDelivery)
+	}
+	if expected.EnableMessageOrdering != existing.EnableMessageOrdering {
+		add(SubscriptionConfigFieldEnableMessageOrdering, existing.EnableMessageOrdering, expected.EnableMessageOrdering)
+	}
+
+	return diffs
+}
+
+// reconcileSubscriptionConfig applies the drift policies to the differences between the existing subscription's config
+// and the expected config.
+func (s *Subscriber) reconcileSubscriptionConfig(
+	ctx context.Context,
+	client *pubsub.Client,
+	sub *pubsub.Subscription,
+	expected, existing pubsub.SubscriptionConfig,
+	topicName, subscriptionName string,
+) (*pubsub.Subscription, error) {
+	logFields := watermill.LogFields{
+		"provider":          ProviderName,
+		"topic":             topicName,
+		"subscription_name": subscriptionName,
+	}
+
+	diffs := s.subscriptionConfigDiffs(expected, existing)
+
+	var failedFields []string
+	recreate := false
+	var toUpdate []subscriptionConfigDiff
+
+	for _, diff := range diffs {
+		s.logger.Info("Existing subscription config differs from the expected config", logFields.Add(watermill.LogFields{
+			"field":     string(diff.field),
+			"old_value": diff.oldValue,
+			"new_value": diff.newValue,
+			"policy":    diff.policy.String(),
+		}))
+
+		switch diff.policy {
+		case SubscriptionConfigDriftFail:
+			failedFields = append(failedFields, string(diff.field))
+		case SubscriptionConfigDriftRecreate:
+			recreate = true
+		case SubscriptionConfigDriftUpdate:
+			if _, ok := immutableSubscriptionConfigFields[diff.field]; ok {
+				return nil, errors.Errorf("subscription field %s can't be updated, use the recreate policy instead", diff.field)
+			}
+			toUpdate = append(toUpdate, diff)
+		}
+	}
+
+	if len(failedFields) > 0 {
+		return nil, errors.Wrapf(ErrSubscriptionConfigDrift, "fields: %s", strings.Join(failedFields, ", "))
+	}
+
+	if recreate {
+		return s.recreateSubscription(ctx, client, sub, topicName, subscriptionName)
+	}
+
+	if len(toUpdate) == 0 {
+		return sub, nil
+	}
+
+	updatedConfig, err := sub.Update(ctx, subscriptionConfigToUpdate(expected, toUpdate))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not update subscription")
+	}
+
+	for _, diff := range toUpdate {
+		s.logger.Info("Updated subscription config field", logFields.Add(watermill.LogFields{
+			"field":     string(diff.field),
+			"old_value": diff.oldValue,
+			"new_value": diff.newValue,
+		}))
+	}
+
+	s.logger.Debug("Updated subscription config", watermill.LogFields{
+		"old_config": existing,
+		"new_config": updatedConfig,
+	})
+
+	return sub, nil
+}
+
+func subscriptionConfigToUpdate(expected pubsub.SubscriptionConfig, diffs []subscriptionConfigDiff) pubsub.SubscriptionConfigToUpdate {
+	var update pubsub.SubscriptionConfigToUpdate
+	for _, diff := range diffs {
+		switch diff.field {
+		case SubscriptionConfigFieldPushEndpoint:
+			update.PushConfig = &expected.PushConfig
+		case SubscriptionConfigFieldAckDeadline:
+			update.AckDeadline = expected.AckDeadline
+		case SubscriptionConfigFieldRetainAckedMessages:
+			update.RetainAckedMessages = expected.RetainAckedMessages
+		case SubscriptionConfigFieldRetentionDuration:
+			update.RetentionDuration = expected.RetentionDuration
+		case SubscriptionConfigFieldExpirationPolicy:
+			update.ExpirationPolicy = expected.ExpirationPolicy
+		case SubscriptionConfigFieldDeadLetterPolicy:
+			update.DeadLetterPolicy = expected.DeadLetterPolicy
+		case SubscriptionConfigFieldRetryPolicy:
+			update.RetryPolicy = expected.RetryPolicy
+		case SubscriptionConfigFieldLabels:
+			update.Labels = expected.Labels
+		case SubscriptionConfigFieldEnableExactlyOnceDelivery:
+			update.EnableExactlyOnceDelivery = expected.EnableExactlyOnceDelivery
+		}
+	}
+
+	return update
+}
+
+// SubscriptionRecreateMode defines how the Subscriber recreates a subscription
+// when its config differs in a field with SubscriptionConfigDriftRecreate policy.
+type SubscriptionRecreateMode int
+
+const (
+	// SubscriptionRecreateDelete deletes the existing subscription and creates it again.
+	// All unacked messages and messages published before the new subscription is created are lost.
+	SubscriptionRecreateDelete SubscriptionRecreateMode = iota
+	// SubscriptionRecreatePreserveBacklog creates a snapshot of the existing subscription before deleting it,
+	// and seeks the new subscription to the snapshot.
+	// Messages unacked by the old subscription and messages published in between are delivered to the new subscription.
+	// The snapshot is deleted once the new subscription is seeked.
+	SubscriptionRecreatePreserveBacklog
+)
+
+func (m SubscriptionRecreateMode) String() string {
+	switch m {
+	case SubscriptionRecreateDelete:
+		return "delete"
+	case SubscriptionRecreatePreserveBacklog:
+		return "preserve_backlog"
+	default:
+		return fmt.Sprintf("SubscriptionRecreateMode(%d)", int(m))
+	}
+}
+
+// recreateSubscription deletes the existing subscription and creates it again with the expected config.
+func (s *Subscriber) recreateSubscription(
+	ctx context.Context,
+	client *pubsub.Client,
+	sub *pubsub.Subscription,
+	topicName, subscriptionName string,
+) (*pubsub.Subscription, error) {
+	logFields := watermill.LogFields{
+		"provider":          ProviderName,
+		"topic":             topicName,
+		"subscription_name": subscriptionName,
+		"recreate_mode":     s.config.RecreateSubscriptionMode.String(),
+	}
+
+	if s.config.RecreateSubscriptionDryRun {
+		s.logger.Info("Dry run, subscription would be recreated, keeping the existing subscription", logFields)
+		return sub, nil
+	}
+
+	var snapshot *pubsub.Snapshot
+	if s.config.RecreateSubscriptionMode == SubscriptionRecreatePreserveBacklog {
+		snapshotConfig, err := sub.CreateSnapshot(ctx, recreateSnapshotName(subscriptionName))
+		if err != nil {
+			return nil, errors.Wrap(err, "could not create snapshot of subscription")
+		}
+		snapshot = snapshotConfig.Snapshot
+		logFields["snapshot"] = snapshot.ID()
+
+		s.logger.Info("Created snapshot of subscription before recreating it", logFields)
+	}
+
+	if err := sub.Delete(ctx); err != nil {
+		return nil, errors.Wrap(err, "could not delete subscription")
+	}
+	s.logger.Info("Deleted subscription", logFields)
+
+	sub, err := s.createSubscription(ctx, client, topicName, subscriptionName)
+	if err != nil {
+		if snapshot != nil {
+			s.logger.Error("Could not create subscription, the backlog is kept in the snapshot", err, logFields)
+		}
+		return nil, err
+	}
+
+	sub.ReceiveSettings = s.config.ReceiveSettings
+
+	if snapshot == nil {
+		return sub, nil
+	}
+
+	if err := sub.SeekToSnapshot(ctx, snapshot); err != nil {
+		s.logger.Error("Could not seek subscription to snapshot, the backlog is kept in the snapshot", err, logFields)
+		return nil, errors.Wrap(err, "could not seek subscription to snapshot")
+	}
+	s.logger.Info("Seeked recreated subscription to snapshot", logFields)
+
+	if err := snapshot.Delete(ctx); err != nil {
+		// The subscription is usable, the snapshot expires on its own.
+		s.logger.Error("Could not delete snapshot", err, logFields)
+	}
+
+	return sub, nil
+}
+
+func recreateSnapshotName(subscriptionName string) string {
+	return fmt.Sprintf("%s-recreate-%d", subscriptionName, time.Now().UnixNano())
+}
+
+// optionalDuration returns the value of an optional.Duration used by the client library.
+func optionalDuration(value interface{}) (time.Duration, bool) {
+	d, ok := value.(time.Duration)
+	return d, ok
+}
+
+// retryPolicyMatches reports if the existing retry policy matches the expected one.
+// Backoffs not set in the expected policy are not compared, as they mean the server default.
+func retryPolicyMatches(expected, existing *pubsub.RetryPolicy) bool {
+	if existing == nil {
+		return false
+	}
+
+	if expectedMin, ok := optionalDuration(expected.MinimumBackoff); ok {
+		if existingMin, _ := optionalDuration(existing.MinimumBackoff); expectedMin != existingMin {
+			return false
+		}
+	}
+	if expectedMax, ok := optionalDuration(expected.MaximumBackoff); ok {
+		if existingMax, _ := optionalDuration(existing.MaximumBackoff); expectedMax != existingMax {
+			return false
+		}
+	}
+
+	return true
+}
+
+func labelsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
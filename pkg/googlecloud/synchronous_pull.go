@@ -0,0 +1,440 @@
+package googlecloud
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	vkit "cloud.google.com/go/pubsub/apiv1"
+	"cloud.google.com/go/pubsub/apiv1/pubsubpb"
+	"github.com/pkg/errors"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// ReceiveMode defines how the Subscriber receives messages from Pub/Sub.
+type ReceiveMode int
+
+const (
+	// ReceiveModeStreamingPull receives messages over a long-lived StreamingPull stream
+	// managed by the client library. It's the default mode.
+	ReceiveModeStreamingPull ReceiveMode = iota
+	// ReceiveModeSynchronousPull receives messages with unary Pull requests,
+	// and acks, nacks and extends ack deadlines with explicit requests.
+	// It's a better fit for batch jobs and for environments where long-lived streams are cut.
+	ReceiveModeSynchronousPull
+)
+
+func (m ReceiveMode) String() string {
+	switch m {
+	case ReceiveModeStreamingPull:
+		return "streaming_pull"
+	case ReceiveModeSynchronousPull:
+		return "synchronous_pull"
+	default:
+		return fmt.Sprintf("ReceiveMode(%d)", int(m))
+	}
+}
+
+// SynchronousPullSettings configures ReceiveModeSynchronousPull.
+type SynchronousPullSettings struct {
+	// MaxMessages is the maximum number of messages returned by a single Pull request.
+	// Messages are pulled while the messages pulled earlier are processed, up to ReceiveSettings.MaxOutstandingMessages
+	// messages at a time. They are processed concurrently, unless message ordering is enabled.
+	// By default, 10 messages are pulled.
+	MaxMessages int
+
+	// WaitInterval defines how long `Subscriber` waits before the next Pull request when no messages were returned.
+	// By default, it waits for a second.
+	WaitInterval time.Duration
+
+	// ClientOptions are used to create the low-level subscriber client that sends the Pull requests,
+	// because pubsub.Client doesn't expose its own. The client is shared by all subscriptions of the `Subscriber`.
+	// By default, the client of SubscriberConfig.ClientPool is used,
+	// or a client is created with SubscriberConfig.ClientOptions.
+	// It must be set if SubscriberConfig.Client is set, because the options of the client can't be read from it.
+	ClientOptions []option.ClientOption
+
+	// AckDeadline is the ack deadline set for pulled messages.
+	// It is extended every half of AckDeadline while the message is processed, up to ReceiveSettings.MaxExtension,
+	// or longer if the handler extends it with ExtendAckDeadline.
+	// It must be between 10 seconds and 10 minutes. By default, 60 seconds is used.
+	AckDeadline time.Duration
+}
+
+func (s *SynchronousPullSettings) setDefaults() {
+	if s.MaxMessages == 0 {
+		s.MaxMessages = 10
+	}
+	if s.WaitInterval == 0 {
+		s.WaitInterval = time.Second
+	}
+	if s.AckDeadline == 0 {
+		s.AckDeadline = time.Minute
+	}
+}
+
+func (s SynchronousPullSettings) validate() error {
+	if s.AckDeadline < 10*time.Second || s.AckDeadline > 10*time.Minute {
+		return errors.Errorf("synchronous pull AckDeadline must be between 10s and 10m, got %s", s.AckDeadline)
+	}
+
+	return nil
+}
+
+// newSubscriberAPIClient creates a low-level subscriber client used by ReceiveModeSynchronousPull.
+// Unlike pubsub.NewClient, the low-level client doesn't use PUBSUB_EMULATOR_HOST,
+// and pubsub.Client doesn't expose its own, so the emulator options are added here.
+func newSubscriberAPIClient(ctx context.Context, opts []option.ClientOption) (*vkit.SubscriberClient, error) {
+	if addr := os.Getenv("PUBSUB_EMULATOR_HOST"); addr != "" {
+		opts = append([]option.ClientOption{
+			option.WithEndpoint(addr),
+			option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+			option.WithoutAuthentication(),
+			option.WithTelemetryDisabled(),
+		}, opts...)
+	}
+
+	client, err := vkit.NewSubscriberClient(ctx, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create subscriber API client")
+	}
+
+	return client, nil
+}
+
+// subscriberAPIClient returns the low-level subscriber client shared by all subscriptions using ReceiveModeSynchronousPull.
+// It's provided by ClientPool, or created on first use and closed with the `Subscriber`.
+func (s *Subscriber) subscriberAPIClient(ctx context.Context) (*vkit.SubscriberClient, error) {
+	opts := s.config.SynchronousPullSettings.ClientOptions
+	if len(opts) == 0 && s.config.ClientPool != nil {
+		return s.config.ClientPool.subscriberAPI(ctx)
+	}
+	if len(opts) == 0 {
+		opts = s.config.ClientOptions
+	}
+
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+
+	if s.apiClient != nil {
+		return s.apiClient, nil
+	}
+
+	// The client outlives the Subscribe call, so it must not be bound to its cancellation.
+	client, err := newSubscriberAPIClient(context.WithoutCancel(ctx), opts)
+	if err != nil {
+		return nil, err
+	}
+	s.apiClient = client
+
+	return client, nil
+}
+
+// pull receives messages with unary Pull requests until receiveCtx is canceled.
+// It keeps pulling while the messages pulled earlier are processed, up to ReceiveSettings.MaxOutstandingMessages
+// messages at a time, and extends the ack deadline of the outstanding messages.
+// The pulled messages are processed with ctx, so they are not nacked when receiveCtx is canceled
+// because the `Subscriber` is draining. It returns once all pulled messages are processed.
+func (s *Subscriber) pull(
+	receiveCtx context.Context,
+	ctx context.Context,
+	client *vkit.SubscriberClient,
+	sub *pubsub.Subscription,
+	tracer *subscriptionTracer,
+	metrics subscriptionMetrics,
+	logFields watermill.LogFields,
+	output chan *message.Message,
+) error {
+	settings := s.config.SynchronousPullSettings
+
+	pulled := &pulledMessages{
+		s:            s,
+		client:       client,
+		subscription: sub.String(),
+		outstanding:  map[string]*messageLease{},
+	}
+	if maxOutstanding := s.config.ReceiveSettings.MaxOutstandingMessages; maxOutstanding >= 0 {
+		if maxOutstanding == 0 {
+			maxOutstanding = pubsub.DefaultReceiveSettings.MaxOutstandingMessages
+		}
+		pulled.slots = make(chan struct{}, maxOutstanding)
+	}
+
+	stopExtending := make(chan struct{})
+	extendingFinished := make(chan struct{})
+	go func() {
+		defer close(extendingFinished)
+		pulled.extendAckDeadlines(ctx, stopExtending, logFields)
+	}()
+
+	processing := sync.WaitGroup{}
+	defer func() {
+		processing.Wait()
+		close(stopExtending)
+		<-extendingFinished
+	}()
+
+	for {
+		maxMessages := pulled.acquire(receiveCtx, settings.MaxMessages)
+		if maxMessages == 0 {
+			return nil
+		}
+
+		resp, err := client.Pull(receiveCtx, &pubsubpb.PullRequest{
+			Subscription: sub.String(),
+			MaxMessages:  int32(maxMessages),
+		})
+		if err != nil {
+			pulled.release(maxMessages)
+			if receiveCtx.Err() != nil {
+				return nil
+			}
+			return errors.Wrap(err, "pull failed")
+		}
+		pulled.release(maxMessages - len(resp.ReceivedMessages))
+
+		if len(resp.ReceivedMessages) == 0 {
+			select {
+			case <-receiveCtx.Done():
+				return nil
+			case <-time.After(settings.WaitInterval):
+			}
+			continue
+		}
+
+		// The ack deadline of the pulled messages is set right away, the outstanding ones are extended periodically.
+		ackIDs := make([]string, 0, len(resp.ReceivedMessages))
+		leases := make([]*messageLease, 0, len(resp.ReceivedMessages))
+		for _, received := range resp.ReceivedMessages {
+			ackIDs = append(ackIDs, received.AckId)
+			leases = append(leases, pulled.add(received.AckId))
+		}
+		pulled.extendAckDeadline(ctx, ackIDs, logFields)
+
+		for i, received := range resp.ReceivedMessages {
+			pubsubMsg := toPubsubMessage(received.Message, received.DeliveryAttempt)
+			msg := pulledMessage{pulled: pulled, ackID: received.AckId, msgLease: leases[i]}
+
+			// Messages with ordering keys are processed one by one, so the order is preserved across Pull requests.
+			if s.config.SubscriptionConfig.EnableMessageOrdering {
+				s.processMessage(ctx, pubsubMsg, msg, tracer, metrics, logFields, output)
+				pulled.release(1)
+				continue
+			}
+
+			processing.Add(1)
+			go func() {
+				defer processing.Done()
+				defer pulled.release(1)
+				s.processMessage(ctx, pubsubMsg, msg, tracer, metrics, logFields, output)
+			}()
+		}
+	}
+}
+
+func toPubsubMessage(pbMsg *pubsubpb.PubsubMessage, deliveryAttempt int32) *pubsub.Message {
+	msg := &pubsub.Message{
+		ID:          pbMsg.MessageId,
+		Data:        pbMsg.Data,
+		Attributes:  pbMsg.Attributes,
+		PublishTime: pbMsg.PublishTime.AsTime(),
+		OrderingKey: pbMsg.OrderingKey,
+	}
+	if deliveryAttempt > 0 {
+		attempt := int(deliveryAttempt)
+		msg.DeliveryAttempt = &attempt
+	}
+
+	return msg
+}
+
+// pulledMessages tracks the outstanding messages pulled from a subscription.
+type pulledMessages struct {
+	s            *Subscriber
+	client       *vkit.SubscriberClient
+	subscription string
+
+	// slots limits the number of outstanding messages. It's nil if the number is not limited.
+	slots chan struct{}
+
+	outstandingLock sync.Mutex
+	outstanding     map[string]*messageLease
+}
+
+// acquire waits until at least one message may be pulled, and reserves up to maxMessages.
+// It returns the number of reserved messages, or 0 if ctx was canceled.
+func (p *pulledMessages) acquire(ctx context.Context, maxMessages int) int {
+	if ctx.Err() != nil {
+		return 0
+	}
+	if p.slots == nil {
+		return maxMessages
+	}
+
+	select {
+	case <-ctx.Done():
+		return 0
+	case p.slots <- struct{}{}:
+	}
+
+	acquired := 1
+	for acquired < maxMessages {
+		select {
+		case p.slots <- struct{}{}:
+			acquired++
+		default:
+			return acquired
+		}
+	}
+
+	return acquired
+}
+
+// release frees the reservations of n messages.
+func (p *pulledMessages) release(n int) {
+	if p.slots == nil {
+		return
+	}
+
+	for i := 0; i < n; i++ {
+		<-p.slots
+	}
+}
+
+// add makes the ack deadline of the message extended until it's done.
+func (p *pulledMessages) add(ackID string) *messageLease {
+	lease := p.s.newPulledMessageLease()
+
+	p.outstandingLock.Lock()
+	defer p.outstandingLock.Unlock()
+
+	p.outstanding[ackID] = lease
+
+	return lease
+}
+
+// done removes the message from the messages whose ack deadline is extended.
+func (p *pulledMessages) done(ackID string) {
+	p.outstandingLock.Lock()
+	defer p.outstandingLock.Unlock()
+
+	delete(p.outstanding, ackID)
+}
+
+// ackIDsToExtend returns the ack IDs of the outstanding messages whose lease still requires extending the ack deadline.
+func (p *pulledMessages) ackIDsToExtend() []string {
+	p.outstandingLock.Lock()
+	defer p.outstandingLock.Unlock()
+
+	now := time.Now()
+	ackIDs := make([]string, 0, len(p.outstanding))
+	for ackID, lease := range p.outstanding {
+		if lease.keepAlive(now) {
+			ackIDs = append(ackIDs, ackID)
+		}
+	}
+
+	return ackIDs
+}
+
+// extendAckDeadlines sets the ack deadline of outstanding messages every half of the deadline, until stop is closed.
+// The ack deadline of a message is extended until the deadline set with DefaultAckExtension or ExtendAckDeadline,
+// or up to ReceiveSettings.MaxExtension after it was pulled if no deadline was set.
+// After that, a message with a deadline is nacked by processMessage, and a message without one is redelivered by Pub/Sub.
+func (p *pulledMessages) extendAckDeadlines(ctx context.Context, stop chan struct{}, logFields watermill.LogFields) {
+	if p.s.config.maxAckExtension() <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(p.s.config.SynchronousPullSettings.AckDeadline / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			p.extendAckDeadline(ctx, p.ackIDsToExtend(), logFields)
+		}
+	}
+}
+
+// extendAckDeadline sets the ack deadline of the messages to SynchronousPullSettings.AckDeadline from now.
+func (p *pulledMessages) extendAckDeadline(ctx context.Context, ackIDs []string, logFields watermill.LogFields) {
+	if len(ackIDs) == 0 || p.s.config.maxAckExtension() <= 0 {
+		return
+	}
+
+	err := p.client.ModifyAckDeadline(context.WithoutCancel(ctx), &pubsubpb.ModifyAckDeadlineRequest{
+		Subscription:       p.subscription,
+		AckIds:             ackIDs,
+		AckDeadlineSeconds: int32(p.s.config.SynchronousPullSettings.AckDeadline.Seconds()),
+	})
+	if err != nil {
+		p.s.logger.Error("Could not extend ack deadline of pulled messages", err, logFields)
+	}
+}
+
+// pulledMessage acks and nacks a message received with ReceiveModeSynchronousPull.
+type pulledMessage struct {
+	pulled   *pulledMessages
+	ackID    string
+	msgLease *messageLease
+}
+
+func (m pulledMessage) lease() *messageLease {
+	return m.msgLease
+}
+
+func (m pulledMessage) ack(ctx context.Context, msg *message.Message, logFields watermill.LogFields) {
+	m.pulled.done(m.ackID)
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), m.pulled.s.config.AckResultTimeout)
+	defer cancel()
+
+	err := m.pulled.client.Acknowledge(ctx, &pubsubpb.AcknowledgeRequest{
+		Subscription: m.pulled.subscription,
+		AckIds:       []string{m.ackID},
+	})
+	if err != nil {
+		m.pulled.s.ackFailed(msg, true, err, logFields.Add(watermill.LogFields{"acked": true}))
+	}
+}
+
+func (m pulledMessage) nack(ctx context.Context, msg *message.Message, logFields watermill.LogFields) {
+	m.pulled.done(m.ackID)
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), m.pulled.s.config.AckResultTimeout)
+	defer cancel()
+
+	if err := m.modifyAckDeadline(ctx, 0); err != nil {
+		m.pulled.s.ackFailed(msg, false, err, logFields.Add(watermill.LogFields{"acked": false}))
+	}
+}
+
+func (m pulledMessage) nackUnconsumed() {
+	m.pulled.done(m.ackID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.pulled.s.config.AckResultTimeout)
+	defer cancel()
+
+	if err := m.modifyAckDeadline(ctx, 0); err != nil {
+		m.pulled.s.logger.Error("Could not nack pulled message", err, nil)
+	}
+}
+
+func (m pulledMessage) modifyAckDeadline(ctx context.Context, ackDeadline time.Duration) error {
+	return m.pulled.client.ModifyAckDeadline(ctx, &pubsubpb.ModifyAckDeadlineRequest{
+		Subscription:       m.pulled.subscription,
+		AckIds:             []string{m.ackID},
+		AckDeadlineSeconds: int32(ackDeadline.Seconds()),
+	})
+}
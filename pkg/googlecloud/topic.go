@@ -0,0 +1,65 @@
+package googlecloud
+
+import (
+	"context"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/ThreeDotsLabs/watermill"
+)
+
+// TopicConfigFn returns the config used to create a topic that does not exist yet.
+// It may be used to set labels, message retention duration, KMS key, message storage policy or schema
+// differently for each topic.
+type TopicConfigFn func(topic string) pubsub.TopicConfig
+
+func staticTopicConfig(config pubsub.TopicConfig) TopicConfigFn {
+	return func(topic string) pubsub.TopicConfig {
+		return config
+	}
+}
+
+type topicProvisioner struct {
+	doNotCreateTopicIfMissing bool
+	topicConfigFn             TopicConfigFn
+
+	logger watermill.LoggerAdapter
+}
+
+// topic returns a handle to an existing topic.
+// If the topic doesn't exist, it is created with the config returned by topicConfigFn,
+// unless doNotCreateTopicIfMissing is set.
+//
+// It is shared by the Publisher and the Subscriber, so both create identical topics.
+func (p topicProvisioner) topic(ctx context.Context, client *pubsub.Client, topicName string) (*pubsub.Topic, error) {
+	t := client.Topic(topicName)
+	exists, err := t.Exists(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not check if topic %s exists", topicName)
+	}
+
+	if exists {
+		return t, nil
+	}
+
+	if p.doNotCreateTopicIfMissing {
+		return nil, errors.Wrap(ErrTopicDoesNotExist, topicName)
+	}
+
+	config := p.topicConfigFn(topicName)
+
+	t, err = client.CreateTopicWithConfig(ctx, topicName, &config)
+	if status.Code(err) == codes.AlreadyExists {
+		p.logger.Debug("Topic already exists", watermill.LogFields{"topic": topicName})
+		return client.Topic(topicName), nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "could not create topic %s", topicName)
+	}
+
+	p.logger.Debug("Topic created", watermill.LogFields{"topic": topicName})
+
+	return t, nil
+}
@@ -0,0 +1,217 @@
+package googlecloud
+
+import (
+	"context"
+
+	"cloud.google.com/go/pubsub"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// tracerName is the name of the OpenTelemetry tracer used by Publisher and Subscriber.
+const tracerName = "github.com/ThreeDotsLabs/watermill-googlecloud/pkg/googlecloud"
+
+// messagingDestinationSubscriptionNameKey is the attribute of the subscription name.
+// It's not part of the semantic conventions version used.
+const messagingDestinationSubscriptionNameKey = attribute.Key("messaging.destination.subscription.name")
+
+// TracingConfig configures OpenTelemetry tracing of Publisher and Subscriber.
+//
+// Publisher starts a span for every published message, and injects its context into the message attributes.
+// Subscriber extracts the context from the attributes, and starts a receive and a process span for every message.
+// The process span is available in msg.Context(), so handlers can continue the trace.
+type TracingConfig struct {
+	// TracerProvider creates the tracer. By default, the global TracerProvider is used.
+	TracerProvider trace.TracerProvider
+	// Propagator injects the trace context into the message attributes and extracts it from them.
+	// By default, the W3C Trace Context propagator is used, so the traceparent and tracestate attributes are set.
+	Propagator propagation.TextMapPropagator
+}
+
+func (c *TracingConfig) setDefaults() {
+	if c.TracerProvider == nil {
+		c.TracerProvider = otel.GetTracerProvider()
+	}
+	if c.Propagator == nil {
+		c.Propagator = propagation.TraceContext{}
+	}
+}
+
+// publishTracer traces the messages published by the Publisher.
+// All methods can be called on a nil publishTracer, when tracing is disabled.
+type publishTracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+func newPublishTracer(config *TracingConfig) *publishTracer {
+	if config == nil {
+		return nil
+	}
+
+	return &publishTracer{
+		tracer:     config.TracerProvider.Tracer(tracerName),
+		propagator: config.Propagator,
+	}
+}
+
+// start starts the publish span of the message and injects its context into the attributes of googlecloudMsg.
+// The span is a child of the span in ctx, or in msg.Context() if ctx has no span.
+func (t *publishTracer) start(ctx context.Context, topic string, msg *message.Message, googlecloudMsg *pubsub.Message) trace.Span {
+	if t == nil {
+		return nil
+	}
+
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		ctx = msg.Context()
+	}
+
+	attributes := []attribute.KeyValue{
+		semconv.MessagingSystemGCPPubsub,
+		semconv.MessagingOperationTypePublish,
+		semconv.MessagingDestinationName(topic),
+	}
+	if googlecloudMsg.OrderingKey != "" {
+		attributes = append(attributes, semconv.MessagingGCPPubsubMessageOrderingKey(googlecloudMsg.OrderingKey))
+	}
+
+	ctx, span := t.tracer.Start(
+		ctx,
+		topic+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attributes...),
+	)
+
+	if googlecloudMsg.Attributes == nil {
+		googlecloudMsg.Attributes = map[string]string{}
+	}
+	t.propagator.Inject(ctx, propagation.MapCarrier(googlecloudMsg.Attributes))
+
+	return span
+}
+
+// end ends the publish span with the result of publishing the message.
+func (t *publishTracer) end(span trace.Span, serverMessageID string, err error) {
+	if t == nil {
+		return
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else {
+		span.SetAttributes(semconv.MessagingMessageID(serverMessageID))
+	}
+	span.End()
+}
+
+// subscriptionTracer traces the messages received from a subscription.
+// All methods can be called on a nil subscriptionTracer, when tracing is disabled.
+type subscriptionTracer struct {
+	tracer           trace.Tracer
+	propagator       propagation.TextMapPropagator
+	topic            string
+	subscriptionName string
+}
+
+func newSubscriptionTracer(config *TracingConfig, topic, subscriptionName string) *subscriptionTracer {
+	if config == nil {
+		return nil
+	}
+
+	return &subscriptionTracer{
+		tracer:           config.TracerProvider.Tracer(tracerName),
+		propagator:       config.Propagator,
+		topic:            topic,
+		subscriptionName: subscriptionName,
+	}
+}
+
+// messageSpans are the spans of a received message.
+// The receive span lasts until the message is delivered to the output channel,
+// and the process span until the message is acked or nacked.
+// All methods can be called on nil messageSpans, when tracing is disabled.
+type messageSpans struct {
+	receive trace.Span
+	process trace.Span
+}
+
+// start extracts the trace context from the message attributes and starts the spans of the message.
+// The returned context carries the process span.
+func (t *subscriptionTracer) start(ctx context.Context, pubsubMsg *pubsub.Message) (context.Context, *messageSpans) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	ctx = t.propagator.Extract(ctx, propagation.MapCarrier(pubsubMsg.Attributes))
+
+	attributes := []attribute.KeyValue{
+		semconv.MessagingSystemGCPPubsub,
+		semconv.MessagingDestinationName(t.topic),
+		messagingDestinationSubscriptionNameKey.String(t.subscriptionName),
+		semconv.MessagingMessageID(pubsubMsg.ID),
+	}
+	if pubsubMsg.OrderingKey != "" {
+		attributes = append(attributes, semconv.MessagingGCPPubsubMessageOrderingKey(pubsubMsg.OrderingKey))
+	}
+	if pubsubMsg.DeliveryAttempt != nil {
+		attributes = append(attributes, semconv.MessagingGCPPubsubMessageDeliveryAttempt(*pubsubMsg.DeliveryAttempt))
+	}
+
+	ctx, receiveSpan := t.tracer.Start(
+		ctx,
+		t.subscriptionName+" receive",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(append(attributes, semconv.MessagingOperationTypeReceive)...),
+	)
+	ctx, processSpan := t.tracer.Start(
+		ctx,
+		t.subscriptionName+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(append(attributes, semconv.MessagingOperationTypeDeliver)...),
+	)
+
+	return ctx, &messageSpans{
+		receive: receiveSpan,
+		process: processSpan,
+	}
+}
+
+// delivered ends the receive span once the message is delivered to the output channel.
+func (s *messageSpans) delivered() {
+	if s == nil {
+		return
+	}
+
+	s.receive.End()
+}
+
+// acked ends the spans once the message is acked.
+func (s *messageSpans) acked() {
+	if s == nil {
+		return
+	}
+
+	s.process.AddEvent("ack")
+	s.process.End()
+	s.receive.End()
+}
+
+// nacked ends the spans once the message is nacked, because of the reason.
+func (s *messageSpans) nacked(reason string) {
+	if s == nil {
+		return
+	}
+
+	s.process.AddEvent("nack")
+	s.process.SetStatus(codes.Error, reason)
+	s.process.End()
+	s.receive.SetStatus(codes.Error, reason)
+	s.receive.End()
+}